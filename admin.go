@@ -0,0 +1,62 @@
+package dilithium
+
+import "fmt"
+
+// Promote makes the shard with the given ID the primary of its parent
+// PrimaryShard.
+func (s *Server) Promote(id string) error {
+	shard := s.forwarding.FindShard(id)
+	if shard == nil {
+		return fmt.Errorf("dilithium: could not find shard '%s'", id)
+	}
+	p, ok := shard.Parent().(*PrimaryShard)
+	if !ok {
+		return fmt.Errorf("dilithium: shard '%s' is not the child of a PrimaryShard", id)
+	}
+	return p.Promote(id)
+}
+
+// PromoteArgs are the arguments of the Promote RPC method.
+type PromoteArgs struct {
+	ID string
+}
+
+// Promote is the RPC method for Server.Promote.
+func (s *rpcServer) Promote(args *PromoteArgs, reply *bool) error {
+	if err := (*Server)(s).Promote(args.ID); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// SetMigrationPhase changes the phase of a MigrateShard, identified by its ID
+// or the ID of its old or new child.
+func (s *Server) SetMigrationPhase(id string, phase string) error {
+	shard := s.forwarding.FindShard(id)
+	if shard == nil {
+		return fmt.Errorf("dilithium: could not find shard '%s'", id)
+	}
+	m, ok := shard.(*MigrateShard)
+	if !ok {
+		if m, ok = shard.Parent().(*MigrateShard); !ok {
+			return fmt.Errorf("dilithium: shard '%s' is not a MigrateShard or its child", id)
+		}
+	}
+	return m.SetPhase(phase)
+}
+
+// MigrationPhaseArgs are the arguments of the SetMigrationPhase RPC method.
+type MigrationPhaseArgs struct {
+	ID    string
+	Phase string
+}
+
+// SetMigrationPhase is the RPC method for Server.SetMigrationPhase.
+func (s *rpcServer) SetMigrationPhase(args *MigrationPhaseArgs, reply *bool) error {
+	if err := (*Server)(s).SetMigrationPhase(args.ID, args.Phase); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
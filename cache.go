@@ -0,0 +1,194 @@
+package dilithium
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+)
+
+// ErrCacheMiss is returned by the read methods of cache services when the
+// requested entry is not cached.
+var ErrCacheMiss = errors.New("dilithium: cache miss")
+
+// CacheShard is a read-through cache. Its first child is the cache and its
+// second the backing store.
+//
+// Reads of the methods in the 'get' object try the cache first, with the cache
+// method configured for the read method. On a miss, signaled by ErrCacheMiss
+// or a zero reply, or on a cache error, the read goes to the backing store and
+// the reply is stored in the cache with the fill method configured for the
+// read method in the 'fill' object. A fill method has the signature of a read
+// method and receives the reply to store as its reply argument. Other reads
+// go to the backing store.
+//
+// Writes go to the backing store. If it succeeds, the cache method
+// configured for the write method in the 'on_write' object is run on the
+// cache with the same argument, to invalidate or update the cached entry. As
+// the write is committed by then, a failure of the cache method is only logged
+// and counted in UpdateErrors, and reads may see the stale entry until it is
+// evicted or filled again.
+type CacheShard struct {
+	baseShard
+	get     map[string]string
+	fill    map[string]string
+	onWrite map[string]string
+	stats   cacheStats
+}
+
+// CacheStats contains the statistics of a CacheShard.
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+	// CacheErrors is the number of cache reads that failed with an error
+	// other than ErrCacheMiss.
+	CacheErrors  int64
+	Fills        int64
+	FillErrors   int64
+	Updates      int64
+	UpdateErrors int64
+}
+
+type cacheStats struct {
+	sync.Mutex
+	CacheStats
+}
+
+func (s *cacheStats) add(field *int64) {
+	s.Lock()
+	*field++
+	s.Unlock()
+}
+
+var errNoCacheChildren = errors.New("dilithium: CacheShard needs a cache and a backing child")
+
+func (c *CacheShard) Setup(config map[string]interface{}) error {
+	get, err := configMethods(config, "get")
+	if err != nil {
+		return err
+	}
+	fill, err := configMethods(config, "fill")
+	if err != nil {
+		return err
+	}
+	onWrite, err := configMethods(config, "on_write")
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.setup(config)
+	c.get = get
+	c.fill = fill
+	c.onWrite = onWrite
+	c.Unlock()
+	return nil
+}
+
+// configMethods returns the object at key in a CacheShard config, mapping
+// method names to method names.
+func configMethods(config map[string]interface{}, key string) (map[string]string, error) {
+	v, ok := config[key]
+	if !ok {
+		return nil, nil
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("dilithium: Invalid CacheShard config '%s', expecting object, got %T", key, v)
+	}
+	methods := make(map[string]string, len(obj))
+	for from, to := range obj {
+		s, ok := to.(string)
+		if !ok {
+			return nil, fmt.Errorf("dilithium: Invalid CacheShard config '%s' for method '%s', expecting string, got %T", key, from, to)
+		}
+		methods[from] = s
+	}
+	return methods, nil
+}
+
+func (c *CacheShard) Query(ctx context.Context, q *Query) error {
+	c.RLock()
+	if len(c.children) < 2 {
+		c.RUnlock()
+		return errNoCacheChildren
+	}
+	cache, backing := c.children[0], c.children[1]
+	get, fill, onWrite := c.get[q.Method], c.fill[q.Method], c.onWrite[q.Method]
+	c.RUnlock()
+
+	if !q.ReadOnly() {
+		if err := backing.Query(ctx, q); err != nil {
+			return err
+		}
+		if onWrite == "" {
+			return nil
+		}
+		c.stats.add(&c.stats.Updates)
+		if _, err := c.runCacheMethod(ctx, cache, onWrite, q, nil); err != nil {
+			c.stats.add(&c.stats.UpdateErrors)
+			log.Printf("dilithium: CacheShard failed to update the cache after %s: %s", q.Method, err)
+		}
+		return nil
+	}
+
+	if get == "" {
+		return backing.Query(ctx, q)
+	}
+	cq, err := c.runCacheMethod(ctx, cache, get, q, nil)
+	if want := reflect.PointerTo(q.method.ReplyType); err == nil && reflect.TypeOf(cq.Reply) != want {
+		err = fmt.Errorf("dilithium: cache method %s replies %T, expecting %s", get, cq.Reply, want)
+	}
+	if err == nil && !reflect.ValueOf(cq.Reply).Elem().IsZero() {
+		c.stats.add(&c.stats.Hits)
+		q.Reply = cq.Reply
+		q.ServedBy = cq.ServedBy
+		return nil
+	}
+	if err != nil && err != ErrCacheMiss {
+		c.stats.add(&c.stats.CacheErrors)
+	}
+	c.stats.add(&c.stats.Misses)
+
+	if err := backing.Query(ctx, q); err != nil {
+		return err
+	}
+	if fill != "" {
+		// a failed fill only costs a later miss
+		c.stats.add(&c.stats.Fills)
+		if _, err := c.runCacheMethod(ctx, cache, fill, q, q.Reply); err != nil {
+			c.stats.add(&c.stats.FillErrors)
+		}
+	}
+	return nil
+}
+
+// runCacheMethod runs method on the cache with the argument of q and, for
+// fill methods, reply as the reply argument.
+func (c *CacheShard) runCacheMethod(ctx context.Context, cache Shard, method string, q *Query, reply interface{}) (*Query, error) {
+	if q.server == nil {
+		return nil, errNoServer
+	}
+	cq := &Query{Method: method, Arg: q.Arg, Timeout: q.Timeout}
+	if err := q.server.resolve(cq); err != nil {
+		return nil, err
+	}
+	if !reflect.TypeOf(q.Arg).AssignableTo(cq.method.ArgType) {
+		return nil, fmt.Errorf("dilithium: cache method %s does not take an argument of type %T", method, q.Arg)
+	}
+	if reply != nil {
+		if !cq.ReadOnly() || reflect.TypeOf(reply) != reflect.PointerTo(cq.method.ReplyType) {
+			return nil, fmt.Errorf("dilithium: fill method %s does not take a reply of type %T", method, reply)
+		}
+		cq.fillReply = reply
+	}
+	return cq, cache.Query(ctx, cq)
+}
+
+// Stats returns the cache statistics.
+func (c *CacheShard) Stats() CacheStats {
+	c.stats.Lock()
+	defer c.stats.Unlock()
+	return c.stats.CacheStats
+}
@@ -45,6 +45,33 @@ func (t *ForwardingTable) Entries() []*ForwardingTableEntry {
 	return entries
 }
 
+// PoolStats returns the pool statistics of every PhysicalShard in the table,
+// keyed by shard ID.
+func (t *ForwardingTable) PoolStats() map[string]PoolStats {
+	stats := make(map[string]PoolStats)
+	for _, e := range t.Entries() {
+		walkShards(e.Shard, func(s Shard) {
+			if p, ok := s.(*PhysicalShard); ok {
+				stats[p.ID()] = p.PoolStats()
+			}
+		})
+	}
+	return stats
+}
+
+// FindShard returns the shard in the table with the given ID, or nil.
+func (t *ForwardingTable) FindShard(id string) Shard {
+	var found Shard
+	for _, e := range t.Entries() {
+		walkShards(e.Shard, func(s Shard) {
+			if found == nil && s.ID() == id {
+				found = s
+			}
+		})
+	}
+	return found
+}
+
 type ForwardingTableEntry struct {
 	MaxKey int
 	Shard  Shard
@@ -0,0 +1,109 @@
+package dilithium
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// HashShard partitions keys across its children by consistent hashing of the
+// query's shard key. Each child is placed on the hash ring 'vnodes' times
+// (100 by default), so adding or removing a child only moves the keys of the
+// ring segments it owns. The virtual nodes are placed by node name, named as
+// in a ReplicateShard, so that keys keep their child when the config is
+// reloaded.
+type HashShard struct {
+	baseShard
+	vnodes int
+	ring   []ringPoint // sorted by hash
+}
+
+// ringPoint is a virtual node of a child on the hash ring.
+type ringPoint struct {
+	hash  uint32
+	shard Shard
+}
+
+const defaultVnodes = 100
+
+var errEmptyRing = errors.New("dilithium: HashShard has no children")
+
+func (h *HashShard) Setup(config map[string]interface{}) error {
+	vnodes, ok, err := configInt(config, "vnodes")
+	if err != nil {
+		return fmt.Errorf("dilithium: Invalid HashShard config 'vnodes': %s", err)
+	}
+	if !ok {
+		vnodes = defaultVnodes
+	}
+	if vnodes == 0 {
+		return errors.New("dilithium: Invalid HashShard config 'vnodes', expecting positive integer")
+	}
+	names, err := parseNodeNames(config, "HashShard")
+	if err != nil {
+		return err
+	}
+	h.Lock()
+	h.setup(config)
+	h.names = &names
+	h.vnodes = vnodes
+	h.buildRing()
+	h.Unlock()
+	return nil
+}
+
+func (h *HashShard) AddChild(s Shard) {
+	h.Lock()
+	h.addChild(s)
+	h.buildRing()
+	h.Unlock()
+}
+
+func (h *HashShard) RemoveChild(id string) {
+	h.Lock()
+	_, s := h.removeChild(id)
+	h.buildRing()
+	h.Unlock()
+	destroyChild(s)
+}
+
+// buildRing places the virtual nodes of every child on the ring. The caller
+// must hold h's lock.
+func (h *HashShard) buildRing() {
+	ring := make([]ringPoint, 0, len(h.children)*h.vnodes)
+	for _, s := range h.children {
+		name := h.names.name(s)
+		for i := 0; i < h.vnodes; i++ {
+			ring = append(ring, ringPoint{crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "-" + name)), s})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	h.ring = ring
+}
+
+// lookup returns the child owning key, the first virtual node at or after the
+// key's hash. The caller must hold h's read lock.
+func (h *HashShard) lookup(key int) Shard {
+	if len(h.ring) == 0 {
+		return nil
+	}
+	hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(key)))
+	i := sort.Search(len(h.ring), func(i int) bool { return h.ring[i].hash >= hash })
+	if i == len(h.ring) {
+		i = 0
+	}
+	return h.ring[i].shard
+}
+
+func (h *HashShard) Query(ctx context.Context, q *Query) error {
+	h.RLock()
+	s := h.lookup(q.Arg.ShardKey())
+	h.RUnlock()
+	if s == nil {
+		return errEmptyRing
+	}
+	return s.Query(ctx, q)
+}
@@ -0,0 +1,149 @@
+package dilithium
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Migration phases of a MigrateShard.
+const (
+	PhaseOldOnly          = "old_only"
+	PhaseDualWriteReadOld = "dual_write_read_old"
+	PhaseDualWriteReadNew = "dual_write_read_new"
+	PhaseNewOnly          = "new_only"
+)
+
+// MigrateShard moves a key range from its first child, the old store, to its
+// second, the new store. The 'phase' decides where queries go:
+//
+//	old_only             reads and writes go to old (the default)
+//	dual_write_read_old  writes go to both, reads to old
+//	dual_write_read_new  writes go to both, reads to new
+//	new_only             reads and writes go to new
+//
+// In the dual write phases, the store that serves reads decides the result of
+// a write, and a write that succeeds on only one store is recorded as a
+// divergence. The phase is changed with SetPhase or Server.SetMigrationPhase
+// and reflected in Config.
+type MigrateShard struct {
+	baseShard
+	phase string
+	stats migrateStats
+}
+
+// MigrateStats contains the statistics of a MigrateShard.
+type MigrateStats struct {
+	DualWrites int64
+	// Divergences is the number of dual writes that succeeded on only one
+	// store, and LastDivergence describes the last one.
+	Divergences    int64
+	LastDivergence string
+}
+
+type migrateStats struct {
+	sync.Mutex
+	MigrateStats
+}
+
+var errNoMigrateChildren = errors.New("dilithium: MigrateShard needs an old and a new child")
+
+func validPhase(phase string) bool {
+	switch phase {
+	case PhaseOldOnly, PhaseDualWriteReadOld, PhaseDualWriteReadNew, PhaseNewOnly:
+		return true
+	}
+	return false
+}
+
+func (m *MigrateShard) Setup(config map[string]interface{}) error {
+	phase := PhaseOldOnly
+	if v, ok := config["phase"]; ok {
+		s, _ := v.(string)
+		if !validPhase(s) {
+			return fmt.Errorf("dilithium: Invalid MigrateShard config 'phase', expecting old_only, dual_write_read_old, dual_write_read_new or new_only, got %v", v)
+		}
+		phase = s
+	}
+	m.Lock()
+	m.setup(config)
+	m.phase = phase
+	m.Unlock()
+	return nil
+}
+
+// Phase returns the migration phase.
+func (m *MigrateShard) Phase() string {
+	m.RLock()
+	defer m.RUnlock()
+	return m.phase
+}
+
+// SetPhase changes the migration phase and records it in the shard's config.
+func (m *MigrateShard) SetPhase(phase string) error {
+	if !validPhase(phase) {
+		return fmt.Errorf("dilithium: invalid MigrateShard phase '%s'", phase)
+	}
+	m.Lock()
+	defer m.Unlock()
+	config := make(map[string]interface{}, len(m.config)+1)
+	for k, v := range m.config {
+		config[k] = v
+	}
+	config["phase"] = phase
+	m.config = config
+	log.Printf("dilithium: MigrateShard phase changed from %s to %s", m.phase, phase)
+	m.phase = phase
+	return nil
+}
+
+func (m *MigrateShard) Query(ctx context.Context, q *Query) error {
+	m.RLock()
+	if len(m.children) < 2 {
+		m.RUnlock()
+		return errNoMigrateChildren
+	}
+	oldStore, newStore, phase := m.children[0], m.children[1], m.phase
+	m.RUnlock()
+
+	readNew := phase == PhaseDualWriteReadNew || phase == PhaseNewOnly
+	if q.ReadOnly() || phase == PhaseOldOnly || phase == PhaseNewOnly {
+		if readNew {
+			return newStore.Query(ctx, q)
+		}
+		return oldStore.Query(ctx, q)
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- newStore.Query(ctx, q) }()
+	oldErr := oldStore.Query(ctx, q)
+	newErr := <-errs
+	m.stats.recordDualWrite(q.Method, oldErr, newErr)
+	if readNew {
+		return newErr
+	}
+	return oldErr
+}
+
+func (s *migrateStats) recordDualWrite(method string, oldErr, newErr error) {
+	s.Lock()
+	defer s.Unlock()
+	s.DualWrites++
+	switch {
+	case oldErr != nil && newErr == nil:
+		s.Divergences++
+		s.LastDivergence = fmt.Sprintf("%s failed on old store: %s", method, oldErr)
+	case oldErr == nil && newErr != nil:
+		s.Divergences++
+		s.LastDivergence = fmt.Sprintf("%s failed on new store: %s", method, newErr)
+	}
+}
+
+// Stats returns the migration statistics.
+func (m *MigrateShard) Stats() MigrateStats {
+	m.stats.Lock()
+	defer m.stats.Unlock()
+	return m.stats.MigrateStats
+}
@@ -0,0 +1,164 @@
+package dilithium
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// MirrorShard answers queries from its first child, the primary, and sends a
+// copy of a 'sample_rate' fraction of them (all by default) to its second
+// child, the shadow. Shadow queries run in the background, bounded by
+// 'shadow_timeout' (1s by default). At most 'max_shadow_inflight' (100 by
+// default) run at once; further copies are dropped, so a slow shadow never
+// delays the primary.
+type MirrorShard struct {
+	baseShard
+	sampleRate    float64
+	shadowTimeout time.Duration
+	inflight      chan struct{} // semaphore of shadow queries
+	stats         mirrorStats
+}
+
+// MirrorStats contains the statistics of a MirrorShard.
+type MirrorStats struct {
+	Queries int64
+	Errors  int64
+	// Latency is the exponentially weighted moving average of the latency of
+	// primary queries.
+	Latency time.Duration
+
+	// Mirrored is the number of queries sent to the shadow and Dropped the
+	// number of sampled queries dropped because too many were in flight.
+	Mirrored        int64
+	Dropped         int64
+	ShadowErrors    int64
+	ShadowLatency   time.Duration
+	ShadowLastError string
+}
+
+type mirrorStats struct {
+	sync.Mutex
+	MirrorStats
+}
+
+const (
+	defaultShadowTimeout     = time.Second
+	defaultMaxShadowInflight = 100
+)
+
+var errNoPrimary = errors.New("dilithium: MirrorShard has no children")
+
+func (m *MirrorShard) Setup(config map[string]interface{}) error {
+	sampleRate := 1.0
+	if v, ok := config["sample_rate"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f > 1 {
+			return fmt.Errorf("dilithium: Invalid MirrorShard config 'sample_rate', expecting number between 0 and 1, got %v", v)
+		}
+		sampleRate = f
+	}
+	shadowTimeout, ok, err := configDuration(config, "shadow_timeout")
+	if err != nil {
+		return fmt.Errorf("dilithium: Invalid MirrorShard config 'shadow_timeout': %s", err)
+	}
+	if !ok {
+		shadowTimeout = defaultShadowTimeout
+	}
+	maxInflight, ok, err := configInt(config, "max_shadow_inflight")
+	if err != nil {
+		return fmt.Errorf("dilithium: Invalid MirrorShard config 'max_shadow_inflight': %s", err)
+	}
+	if !ok {
+		maxInflight = defaultMaxShadowInflight
+	}
+	m.Lock()
+	m.setup(config)
+	m.sampleRate = sampleRate
+	m.shadowTimeout = shadowTimeout
+	m.inflight = make(chan struct{}, maxInflight)
+	m.Unlock()
+	return nil
+}
+
+func (m *MirrorShard) Query(ctx context.Context, q *Query) error {
+	m.RLock()
+	var primary, shadow Shard
+	if len(m.children) > 0 {
+		primary = m.children[0]
+	}
+	if len(m.children) > 1 {
+		shadow = m.children[1]
+	}
+	sampleRate, timeout, inflight := m.sampleRate, m.shadowTimeout, m.inflight
+	m.RUnlock()
+	if primary == nil {
+		return errNoPrimary
+	}
+
+	if shadow != nil && rand.Float64() < sampleRate {
+		select {
+		case inflight <- struct{}{}:
+			m.stats.mirrored()
+			go func(q *Query) {
+				sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+				start := time.Now()
+				err := shadow.Query(sctx, q)
+				cancel()
+				<-inflight
+				m.stats.finishShadow(time.Since(start), err)
+			}(q.clone())
+		default:
+			m.stats.dropped()
+		}
+	}
+
+	start := time.Now()
+	err := primary.Query(ctx, q)
+	m.stats.finishPrimary(time.Since(start), err)
+	return err
+}
+
+func (s *mirrorStats) mirrored() {
+	s.Lock()
+	s.Mirrored++
+	s.Unlock()
+}
+
+func (s *mirrorStats) dropped() {
+	s.Lock()
+	s.Dropped++
+	s.Unlock()
+}
+
+func (s *mirrorStats) finishPrimary(latency time.Duration, err error) {
+	s.Lock()
+	s.Queries++
+	if err != nil {
+		s.Errors++
+	} else {
+		s.Latency = decayLatency(s.Latency, latency)
+	}
+	s.Unlock()
+}
+
+func (s *mirrorStats) finishShadow(latency time.Duration, err error) {
+	s.Lock()
+	if err != nil {
+		s.ShadowErrors++
+		s.ShadowLastError = err.Error()
+	} else {
+		s.ShadowLatency = decayLatency(s.ShadowLatency, latency)
+	}
+	s.Unlock()
+}
+
+// Stats returns the statistics of the primary and shadow queries.
+func (m *MirrorShard) Stats() MirrorStats {
+	m.stats.Lock()
+	defer m.stats.Unlock()
+	return m.stats.MirrorStats
+}
@@ -0,0 +1,108 @@
+package dilithium
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// nodeNames names the children of a shard so that its config can refer to
+// them across restarts, as only PhysicalShards have stable IDs. The names are
+// kept in the 'nodes' config list, in child order. A child without a
+// configured name is named after its URL if it is a PhysicalShard, and after
+// the lowest unused integer otherwise.
+type nodeNames struct {
+	configured []string
+	names      map[Shard]string
+	used       map[string]bool
+}
+
+// parseNodeNames parses the 'nodes' config list of a shard of the given type.
+func parseNodeNames(config map[string]interface{}, shardType string) (nodeNames, error) {
+	v, ok := config["nodes"]
+	if !ok {
+		return nodeNames{}, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nodeNames{}, fmt.Errorf("dilithium: Invalid %s config 'nodes', expecting list, got %T", shardType, v)
+	}
+	names := make([]string, len(list))
+	seen := make(map[string]bool, len(list))
+	for i, v := range list {
+		s, ok := v.(string)
+		if !ok || s == "" {
+			return nodeNames{}, fmt.Errorf("dilithium: Invalid %s config 'nodes', expecting non-empty string, got %v", shardType, v)
+		}
+		if seen[s] {
+			return nodeNames{}, fmt.Errorf("dilithium: Invalid %s config 'nodes', duplicate name '%s'", shardType, s)
+		}
+		seen[s] = true
+		names[i] = s
+	}
+	return nodeNames{configured: names}, nil
+}
+
+// add names s, the ith child.
+func (n *nodeNames) add(s Shard, i int) string {
+	if n.names == nil {
+		n.names = make(map[Shard]string)
+		n.used = make(map[string]bool)
+	}
+	var name string
+	if i < len(n.configured) && !n.used[n.configured[i]] {
+		name = n.configured[i]
+	} else if p, ok := s.(*PhysicalShard); ok && !n.used[p.ID()] {
+		name = p.ID()
+	} else {
+		for j := 0; ; j++ {
+			if name = strconv.Itoa(j); !n.used[name] {
+				break
+			}
+		}
+	}
+	n.names[s] = name
+	n.used[name] = true
+	return name
+}
+
+func (n *nodeNames) remove(s Shard) {
+	delete(n.used, n.names[s])
+	delete(n.names, s)
+}
+
+// name returns the name of child s. Without names, it returns the child's ID.
+func (n *nodeNames) name(s Shard) string {
+	if n == nil {
+		return s.ID()
+	}
+	return n.names[s]
+}
+
+// child returns the child with the given name, or nil.
+func (n *nodeNames) child(name string) Shard {
+	for s, sn := range n.names {
+		if sn == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// list returns the names of children for the 'nodes' config.
+func (n *nodeNames) list(children []Shard) []interface{} {
+	list := make([]interface{}, len(children))
+	for i, s := range children {
+		list[i] = n.name(s)
+	}
+	return list
+}
+
+// withConfig returns a copy of config with key set to v.
+func withConfig(config map[string]interface{}, key string, v interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(config)+1)
+	for k, v := range config {
+		c[k] = v
+	}
+	c[key] = v
+	return c
+}
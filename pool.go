@@ -17,7 +17,10 @@ package dilithium
 
 import (
 	"container/list"
+	"context"
 	"errors"
+	"fmt"
+	"reflect"
 	"sync"
 	"time"
 )
@@ -26,6 +29,20 @@ var nowFunc = time.Now // for testing
 
 var errPoolClosed = errors.New("dilithium: connection pool closed")
 
+var errGetOnClosed = errors.New("dilithium: get on closed pool")
+
+// ErrCircuitOpen is returned from Get when the pool needs to dial a new
+// connection but has stopped dialing after consecutive dial failures.
+var ErrCircuitOpen = errors.New("dilithium: connection pool circuit open")
+
+// ErrPoolExhausted is returned from Get when the maximum number of active
+// connections in the pool has been reached and Wait is false.
+var ErrPoolExhausted = errors.New("dilithium: connection pool exhausted")
+
+// ErrBrokenConn can be returned, or wrapped, by a query method to have its
+// connection closed instead of being returned to the pool.
+var ErrBrokenConn = errors.New("dilithium: broken connection")
+
 // Pool maintains a pool of connections. The application calls the Get method
 // to get a connection from the pool and the connection's Close method to
 // return the connection's resources to the pool.
@@ -33,6 +50,17 @@ type Pool struct {
 	// Dial is an application supplied function for creating new connections.
 	Dial func(url string) (Closer, error)
 
+	// DialConfig is an alternative to Dial for pools that need more than the
+	// URL to connect. It receives the config of the PhysicalShard the pool
+	// belongs to, or nil if the pool is used on its own, and should stop
+	// dialing when ctx is done. If set, Dial is not used.
+	DialConfig func(ctx context.Context, config map[string]interface{}) (Closer, error)
+
+	// Give up on dials that take longer than this duration. A connection
+	// dialed after giving up is closed. If the value is zero, then dials are
+	// only abandoned when the context passed to GetContext is done.
+	DialTimeout time.Duration
+
 	// TestOnBorrow is an optional application supplied function for checking
 	// the health of an idle connection before the connection is used again by
 	// the application. Argument t is the time that the connection was returned
@@ -40,32 +68,146 @@ type Pool struct {
 	// closed.
 	TestOnBorrow func(c Closer, t time.Time) error
 
+	// IsFatal is an optional application supplied function for classifying
+	// errors returned by queries run on a connection. If the function returns
+	// true, then the connection is marked broken and closed instead of being
+	// returned to the pool.
+	IsFatal func(err error) bool
+
 	// Maximum number of idle connections in the pool.
 	MaxIdle int
 
+	// Minimum number of idle connections in the pool. Warm dials connections
+	// up to this number and a background goroutine keeps the pool topped up
+	// as connections are closed. The value is capped at MaxIdle.
+	MinIdle int
+
+	// Maximum number of connections allocated by the pool at a given time.
+	// When zero, there is no limit on the number of connections in the pool.
+	MaxActive int
+
+	// If Wait is true and the pool is at the MaxActive limit, then Get waits
+	// for a connection to be returned to the pool before returning. GetContext
+	// stops waiting when its context is done.
+	Wait bool
+
 	// Close connections after remaining idle for this duration. If the value
 	// is zero, then idle connections are not closed. Applications should set
 	// the timeout to a value less than the server's timeout.
 	IdleTimeout time.Duration
 
+	// Close connections older than this duration. Idle connections are closed
+	// by a background reaper, connections in use are closed when they are
+	// returned to the pool. If the value is zero, then connections are not
+	// closed due to their age.
+	MaxConnLifetime time.Duration
+
+	// Number of consecutive dial failures after which the pool opens its
+	// circuit and fails dials fast with ErrCircuitOpen. While the circuit is
+	// open, idle connections are still used. After a backoff a single probe
+	// dial is allowed; if it succeeds the circuit closes, otherwise it stays
+	// open for twice as long. If the value is zero, then the circuit never
+	// opens.
+	BreakerThreshold int
+
+	// Initial time the circuit stays open. Defaults to one second.
+	BreakerBackoff time.Duration
+
+	// Maximum time the circuit stays open between probes. Defaults to one
+	// minute.
+	BreakerMaxBackoff time.Duration
+
 	// url is the connection string used by Dial, typically a URL
 	url string
 
+	// config is the PhysicalShard config passed to DialConfig.
+	config map[string]interface{}
+
+	// connType is the type of the connections dialed by the pool, if known.
+	connType reflect.Type
+
 	// mu protects fields defined below.
 	mu     sync.Mutex
 	closed bool
+	active int
+	stats  PoolStats
+
+	// waitCh is closed to wake up callers waiting for a connection.
+	waitCh chan struct{}
+
+	// reaperStop is closed by Close to stop the reaper goroutine, which
+	// closes reaperDone on exit. reaperFill wakes up the reaper to top up
+	// the idle list after a connection is closed.
+	reaperStop chan struct{}
+	reaperDone chan struct{}
+	reaperFill chan struct{}
+
+	// Number of connections being dialed by fill.
+	filling int
+
+	// Connections handed out by Get and not yet returned.
+	out map[*pooledConnection]Closer
+
+	// Circuit breaker state.
+	dialFailures int
+	circuitOpen  bool
+	probing      bool
+	openUntil    time.Time
+	backoff      time.Duration
 
 	// Stack of idleConn with most recently used at the front.
 	idle list.List
 }
 
+// PoolStats is a snapshot of a pool's connection counts and counters.
+type PoolStats struct {
+	// ActiveCount is the number of connections allocated by the pool, both
+	// idle and in use.
+	ActiveCount int
+	// IdleCount is the number of idle connections in the pool.
+	IdleCount int
+
+	// Dials is the number of connections dialed, including failed dials.
+	Dials int64
+	// DialErrors is the number of dials that returned an error.
+	DialErrors int64
+	// TestOnBorrowFailures is the number of idle connections closed because
+	// TestOnBorrow returned an error.
+	TestOnBorrowFailures int64
+	// IdleTimeoutClosed is the number of idle connections closed because they
+	// exceeded IdleTimeout.
+	IdleTimeoutClosed int64
+	// LifetimeClosed is the number of connections closed because they
+	// exceeded MaxConnLifetime.
+	LifetimeClosed int64
+	// BrokenClosed is the number of connections closed instead of being
+	// returned to the pool because they were marked broken.
+	BrokenClosed int64
+	// ForcedClosed is the number of connections in use closed by Drain.
+	ForcedClosed int64
+
+	// CircuitOpen reports whether the pool has stopped dialing.
+	CircuitOpen bool
+	// CircuitOpens is the number of times the circuit opened.
+	CircuitOpens int64
+	// CircuitRejects is the number of dials rejected while the circuit was
+	// open.
+	CircuitRejects int64
+
+	// WaitCount is the number of Get calls that waited for a connection.
+	WaitCount int64
+	// WaitDuration is the total time spent waiting for connections.
+	WaitDuration time.Duration
+}
+
 type Closer interface {
 	Close()
 }
 
 type idleConn struct {
-	c Closer
-	t time.Time
+	c       Closer
+	t       time.Time // when the connection was returned to the pool
+	created time.Time
 }
 
 // NewPool returns a pool that uses newPool to create connections as needed.
@@ -74,11 +216,65 @@ func NewPool(newFn func(string) (Closer, error), maxIdle int) *Pool {
 	return &Pool{Dial: newFn, MaxIdle: maxIdle}
 }
 
+// clone returns a new pool for url with the settings of p.
+func (p *Pool) clone(url string) *Pool {
+	return &Pool{
+		url:               url,
+		connType:          p.connType,
+		Dial:              p.Dial,
+		DialConfig:        p.DialConfig,
+		DialTimeout:       p.DialTimeout,
+		TestOnBorrow:      p.TestOnBorrow,
+		IsFatal:           p.IsFatal,
+		MaxIdle:           p.MaxIdle,
+		MinIdle:           p.MinIdle,
+		MaxActive:         p.MaxActive,
+		Wait:              p.Wait,
+		IdleTimeout:       p.IdleTimeout,
+		MaxConnLifetime:   p.MaxConnLifetime,
+		BreakerThreshold:  p.BreakerThreshold,
+		BreakerBackoff:    p.BreakerBackoff,
+		BreakerMaxBackoff: p.BreakerMaxBackoff,
+	}
+}
+
 // Get gets a connection from the pool.
 func (p *Pool) Get() (*pooledConnection, error) {
+	return p.GetContext(context.Background())
+}
+
+// GetContext gets a connection from the pool. If the pool is waiting for a
+// connection to be returned or the context is done before a new connection is
+// dialed, the context's error is returned.
+func (p *Pool) GetContext(ctx context.Context) (*pooledConnection, error) {
 	c := &pooledConnection{p: p}
-	err := c.get()
-	return c, err
+	c.checkout(ctx)
+	return c, c.err
+}
+
+// Warm dials connections in parallel until the pool holds MinIdle idle
+// connections and starts the background goroutine that keeps it topped up.
+// Warm returns the first dial error, or the context's error if it is done
+// before the dials finish. Connections dialed after that are still added to
+// the pool.
+func (p *Pool) Warm(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.startReaper()
+	}
+	p.mu.Unlock()
+	return p.fill(ctx)
+}
+
+// Stats returns a snapshot of the pool's statistics.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.ActiveCount = p.active
+	stats.IdleCount = p.idle.Len()
+	stats.CircuitOpen = p.circuitOpen
+	return stats
 }
 
 // Close releases the resources used by the pool.
@@ -87,96 +283,542 @@ func (p *Pool) Close() {
 	idle := p.idle
 	p.idle.Init()
 	p.closed = true
+	p.active -= idle.Len()
+	p.notify()
+	stop, done := p.reaperStop, p.reaperDone
+	p.reaperStop = nil
 	p.mu.Unlock()
 	for e := idle.Front(); e != nil; e = e.Next() {
 		e.Value.(idleConn).c.Close()
 	}
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Drain stops the pool from handing out connections, closes the idle
+// connections and waits for the connections in use to be returned before
+// closing them. Connections still in use when ctx is done are closed
+// immediately and closing them later is a no-op. Drain returns the number of
+// connections it closed while they were in use.
+func (p *Pool) Drain(ctx context.Context) int {
+	p.Close()
+	p.mu.Lock()
+	for len(p.out) > 0 {
+		if p.waitCh == nil {
+			p.waitCh = make(chan struct{})
+		}
+		wait := p.waitCh
+		p.mu.Unlock()
+		select {
+		case <-wait:
+			p.mu.Lock()
+		case <-ctx.Done():
+			p.mu.Lock()
+			forced := make([]Closer, 0, len(p.out))
+			for pc, c := range p.out {
+				forced = append(forced, c)
+				delete(p.out, pc)
+			}
+			p.active -= len(forced)
+			p.stats.ForcedClosed += int64(len(forced))
+			p.mu.Unlock()
+			closeAll(forced)
+			return len(forced)
+		}
+	}
+	p.mu.Unlock()
+	return 0
 }
 
 // get prunes stale connections and returns a connection from the idle list or
 // creates a new connection.
-func (p *Pool) get() (Closer, error) {
+func (p *Pool) get(ctx context.Context) (Closer, time.Time, error) {
+	var waitStart time.Time
+	defer func() {
+		if !waitStart.IsZero() {
+			p.mu.Lock()
+			p.stats.WaitDuration += nowFunc().Sub(waitStart)
+			p.mu.Unlock()
+		}
+	}()
+
 	p.mu.Lock()
 
-	if p.closed {
-		p.mu.Unlock()
-		return nil, errors.New("dilithium: get on closed pool")
+	if !p.closed {
+		p.startReaper()
 	}
 
 	// Prune stale connections.
-	if timeout := p.IdleTimeout; timeout > 0 {
+	if stale := p.prune(); len(stale) > 0 {
+		p.mu.Unlock()
+		closeAll(stale)
+		p.mu.Lock()
+	}
+
+	for {
+		// Get idle connection.
 		for i, n := 0, p.idle.Len(); i < n; i++ {
-			e := p.idle.Back()
+			e := p.idle.Front()
 			if e == nil {
 				break
 			}
 			ic := e.Value.(idleConn)
-			if ic.t.Add(timeout).After(nowFunc()) {
-				break
-			}
 			p.idle.Remove(e)
+			if p.expired(ic.created, nowFunc()) {
+				p.release()
+				p.stats.LifetimeClosed++
+				p.mu.Unlock()
+				ic.c.Close()
+				p.mu.Lock()
+				continue
+			}
+			test := p.TestOnBorrow
 			p.mu.Unlock()
+			if test == nil || test(ic.c, ic.t) == nil {
+				return ic.c, ic.created, nil
+			}
 			ic.c.Close()
 			p.mu.Lock()
+			p.release()
+			p.stats.TestOnBorrowFailures++
 		}
-	}
 
-	// Get idle connection.
-	for i, n := 0, p.idle.Len(); i < n; i++ {
-		e := p.idle.Front()
-		if e == nil {
-			break
+		// Check for pool closed before dialing a new connection.
+		if p.closed {
+			p.mu.Unlock()
+			return nil, time.Time{}, errGetOnClosed
 		}
-		ic := e.Value.(idleConn)
-		p.idle.Remove(e)
-		test := p.TestOnBorrow
+
+		if err := ctx.Err(); err != nil {
+			p.mu.Unlock()
+			return nil, time.Time{}, err
+		}
+
+		// Dial new connection if under limit.
+		if p.MaxActive == 0 || p.active < p.MaxActive {
+			probe, err := p.allowDial()
+			if err != nil {
+				p.mu.Unlock()
+				return nil, time.Time{}, err
+			}
+			p.active++
+			p.stats.Dials++
+			p.mu.Unlock()
+			c, err := p.dial(ctx, probe)
+			return c, nowFunc(), err
+		}
+
+		if !p.Wait {
+			p.mu.Unlock()
+			return nil, time.Time{}, ErrPoolExhausted
+		}
+
+		if waitStart.IsZero() {
+			waitStart = nowFunc()
+			p.stats.WaitCount++
+		}
+		if p.waitCh == nil {
+			p.waitCh = make(chan struct{})
+		}
+		wait := p.waitCh
 		p.mu.Unlock()
-		if test != nil && test(ic.c, ic.t) != nil {
-			ic.c.Close()
-		} else {
-			return ic.c, nil
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, time.Time{}, ctx.Err()
 		}
 		p.mu.Lock()
 	}
+}
 
-	// No idle connection, create new.
-	dial := p.Dial
+// track records pc as handed out, unless the pool was closed while its
+// connection was being dialed. The caller must not hold p.mu.
+func (p *Pool) track(pc *pooledConnection) error {
+	p.mu.Lock()
+	if p.closed {
+		p.release()
+		p.mu.Unlock()
+		pc.c.Close()
+		return errGetOnClosed
+	}
+	if p.out == nil {
+		p.out = make(map[*pooledConnection]Closer)
+	}
+	p.out[pc] = pc.c
 	p.mu.Unlock()
-	return dial(p.url)
+	return nil
 }
 
-func (p *Pool) put(c Closer) {
+func (p *Pool) put(pc *pooledConnection) {
+	c := pc.c
 	p.mu.Lock()
-	if !p.closed {
-		p.idle.PushFront(idleConn{t: nowFunc(), c: c})
+	if _, ok := p.out[pc]; !ok {
+		// Drain already closed the connection.
+		p.mu.Unlock()
+		return
+	}
+	delete(p.out, pc)
+	if pc.broken {
+		p.stats.BrokenClosed++
+	} else if p.expired(pc.created, nowFunc()) {
+		p.stats.LifetimeClosed++
+	} else if !p.closed {
+		p.idle.PushFront(idleConn{t: nowFunc(), c: c, created: pc.created})
 		if p.idle.Len() > p.MaxIdle {
 			c = p.idle.Remove(p.idle.Back()).(idleConn).c
 		} else {
 			c = nil
 		}
 	}
+	if c == nil {
+		p.notify()
+		p.mu.Unlock()
+		return
+	}
+	p.release()
+	p.mu.Unlock()
+	c.Close()
+}
+
+// dial dials a new connection for a slot already counted in p.active and
+// p.stats.Dials, releasing the slot if the dial fails. Argument probe is the
+// value returned by allowDial.
+func (p *Pool) dial(ctx context.Context, probe bool) (Closer, error) {
+	c, err := p.dialContext(ctx)
+	p.mu.Lock()
+	if err != nil && ctx.Err() != nil {
+		// The caller gave up, which says nothing about the backend.
+		if probe {
+			p.probing = false
+		}
+	} else {
+		p.dialDone(err, probe)
+	}
+	if err != nil {
+		p.release()
+		p.stats.DialErrors++
+		c = nil
+	}
+	p.mu.Unlock()
+	return c, err
+}
+
+// dialContext calls Dial, giving up when ctx is done or DialTimeout elapses.
+func (p *Pool) dialContext(parent context.Context) (Closer, error) {
+	ctx := parent
+	if p.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, p.DialTimeout)
+		defer cancel()
+	}
+	if p.DialConfig != nil {
+		c, err := p.DialConfig(ctx, p.config)
+		if err != nil && parent.Err() == nil && ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("dilithium: dial %s timed out after %s", p.url, p.DialTimeout)
+		}
+		return c, err
+	}
+	if ctx.Done() == nil {
+		return p.Dial(p.url)
+	}
+
+	type result struct {
+		c   Closer
+		err error
+	}
+	res := make(chan result, 1)
+	go func() {
+		c, err := p.Dial(p.url)
+		res <- result{c, err}
+	}()
+	select {
+	case r := <-res:
+		return r.c, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-res; r.c != nil {
+				r.c.Close()
+			}
+		}()
+		if err := parent.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("dilithium: dial %s timed out after %s", p.url, p.DialTimeout)
+	}
+}
+
+// allowDial reports whether the circuit breaker allows a dial and whether the
+// dial is the probe of an open circuit. The caller must hold p.mu during the
+// call and pass probe to dial.
+func (p *Pool) allowDial() (probe bool, err error) {
+	if !p.circuitOpen {
+		return false, nil
+	}
+	if p.probing || nowFunc().Before(p.openUntil) {
+		p.stats.CircuitRejects++
+		return false, ErrCircuitOpen
+	}
+	p.probing = true
+	return true, nil
+}
+
+// dialDone updates the circuit breaker with the outcome of a dial. The caller
+// must hold p.mu during the call.
+func (p *Pool) dialDone(err error, probe bool) {
+	if probe {
+		p.probing = false
+	}
+	if err == nil {
+		p.dialFailures = 0
+		p.circuitOpen = false
+		p.backoff = 0
+		return
+	}
+	p.dialFailures++
+	switch {
+	case probe:
+		max := p.BreakerMaxBackoff
+		if max == 0 {
+			max = time.Minute
+		}
+		p.backoff *= 2
+		if p.backoff > max {
+			p.backoff = max
+		}
+	case !p.circuitOpen && p.BreakerThreshold > 0 && p.dialFailures >= p.BreakerThreshold:
+		p.circuitOpen = true
+		p.backoff = p.BreakerBackoff
+		if p.backoff == 0 {
+			p.backoff = time.Second
+		}
+		p.stats.CircuitOpens++
+	default:
+		return
+	}
+	p.openUntil = nowFunc().Add(p.backoff)
+}
+
+// fill dials connections in parallel until the pool holds MinIdle idle
+// connections, and waits for the dials to finish or ctx to be done.
+func (p *Pool) fill(ctx context.Context) error {
+	p.mu.Lock()
+	n := p.MinIdle
+	if n > p.MaxIdle {
+		n = p.MaxIdle
+	}
+	n -= p.idle.Len() + p.filling
+	if p.MaxActive > 0 && n > p.MaxActive-p.active {
+		n = p.MaxActive - p.active
+	}
+	if p.closed || n <= 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	probe, err := p.allowDial()
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	if probe {
+		n = 1
+	}
+	p.active += n
+	p.filling += n
+	p.stats.Dials += int64(n)
 	p.mu.Unlock()
-	if c != nil {
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			c, err := p.dial(context.Background(), probe)
+			p.mu.Lock()
+			p.filling--
+			if c != nil && p.closed {
+				p.release()
+			} else if c != nil {
+				now := nowFunc()
+				p.idle.PushBack(idleConn{t: now, c: c, created: now})
+				p.notify()
+				c = nil
+			}
+			p.mu.Unlock()
+			if c != nil {
+				c.Close()
+			}
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case e := <-errs:
+			if err == nil {
+				err = e
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// expired reports whether a connection created at the given time has exceeded
+// MaxConnLifetime.
+func (p *Pool) expired(created, now time.Time) bool {
+	return p.MaxConnLifetime > 0 && !created.Add(p.MaxConnLifetime).After(now)
+}
+
+// prune removes idle connections that have exceeded IdleTimeout or
+// MaxConnLifetime from the idle list and returns them. The caller must hold
+// p.mu during the call and close the returned connections after releasing it.
+func (p *Pool) prune() []Closer {
+	var stale []Closer
+	now := nowFunc()
+	for e := p.idle.Back(); e != nil; {
+		prev := e.Prev()
+		ic := e.Value.(idleConn)
+		switch {
+		case p.IdleTimeout > 0 && !ic.t.Add(p.IdleTimeout).After(now):
+			p.stats.IdleTimeoutClosed++
+		case p.expired(ic.created, now):
+			p.stats.LifetimeClosed++
+		default:
+			e = prev
+			continue
+		}
+		p.idle.Remove(e)
+		p.release()
+		stale = append(stale, ic.c)
+		e = prev
+	}
+	return stale
+}
+
+// startReaper starts the goroutine that prunes stale idle connections and
+// tops up the idle list in the background, if the pool has a timeout or
+// MinIdle and it is not already running. The caller must hold p.mu during the
+// call.
+func (p *Pool) startReaper() {
+	if p.reaperStop != nil {
+		return
+	}
+	interval := p.IdleTimeout
+	if l := p.MaxConnLifetime; l > 0 && (interval == 0 || l < interval) {
+		interval = l
+	}
+	interval /= 2
+	if interval == 0 && p.MinIdle > 0 {
+		interval = time.Second
+	}
+	if interval == 0 {
+		return
+	}
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	p.reaperStop = make(chan struct{})
+	p.reaperDone = make(chan struct{})
+	p.reaperFill = make(chan struct{}, 1)
+	go p.reaper(interval, p.reaperStop, p.reaperDone, p.reaperFill)
+}
+
+func (p *Pool) reaper(interval time.Duration, stop <-chan struct{}, done chan<- struct{}, fill <-chan struct{}) {
+	defer close(done)
+	// Cancel fills in progress when the pool is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-fill:
+		case <-stop:
+			return
+		}
+		p.mu.Lock()
+		stale := p.prune()
+		p.mu.Unlock()
+		closeAll(stale)
+		p.fill(ctx)
+	}
+}
+
+func closeAll(conns []Closer) {
+	for _, c := range conns {
 		c.Close()
 	}
 }
 
+// release decrements the active count and wakes up waiters. The caller must
+// hold p.mu during the call.
+func (p *Pool) release() {
+	p.active--
+	p.notify()
+	if p.reaperFill != nil && p.MinIdle > 0 {
+		select {
+		case p.reaperFill <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// notify wakes up all callers waiting for a connection. The caller must hold
+// p.mu during the call.
+func (p *Pool) notify() {
+	if p.waitCh != nil {
+		close(p.waitCh)
+		p.waitCh = nil
+	}
+}
+
 type pooledConnection struct {
-	c   Closer
-	err error
-	p   *Pool
+	c       Closer
+	created time.Time
+	broken  bool
+	err     error
+	p       *Pool
 }
 
 func (c *pooledConnection) get() error {
 	if c.err == nil && c.c == nil {
-		c.c, c.err = c.p.get()
+		c.checkout(context.Background())
 	}
 	return c.err
 }
 
+// checkout gets a connection from the pool and records it as handed out.
+func (c *pooledConnection) checkout(ctx context.Context) {
+	c.c, c.created, c.err = c.p.get(ctx)
+	if c.err == nil {
+		if c.err = c.p.track(c); c.err != nil {
+			c.c = nil
+		}
+	}
+}
+
+// MarkBroken marks the connection as broken, so that Close closes it instead
+// of returning it to the pool.
+func (c *pooledConnection) MarkBroken() {
+	c.broken = true
+}
+
+// CheckErr marks the connection as broken if err is ErrBrokenConn or is
+// classified as fatal by the pool's IsFatal function.
+func (c *pooledConnection) CheckErr(err error) {
+	if errors.Is(err, ErrBrokenConn) || err != nil && c.p.IsFatal != nil && c.p.IsFatal(err) {
+		c.broken = true
+	}
+}
+
 func (c *pooledConnection) Close() {
 	if c.c != nil {
-		c.p.put(c.c)
+		c.p.put(c)
 		c.c = nil
 		c.err = errPoolClosed
 	}
@@ -199,3 +841,78 @@ func RegisterPoolType(name string, pool *Pool) {
 	defer poolTypesMtx.Unlock()
 	poolTypes[name] = pool
 }
+
+// TypedPool is a pool whose connections are of type T. Queries run on a
+// PhysicalShard using a TypedPool are checked against the connection type of
+// the service method before it is called.
+type TypedPool[T Closer] struct {
+	*Pool
+}
+
+// PooledConn is a connection of type T handed out by a TypedPool. The
+// application calls Close to return it to the pool.
+type PooledConn[T Closer] struct {
+	Conn T
+	*pooledConnection
+}
+
+// NewTypedPool returns a pool that uses dial to create connections of type T
+// as needed. The pool keeps a maximum of maxIdle idle connections.
+func NewTypedPool[T Closer](dial func(url string) (T, error), maxIdle int) *TypedPool[T] {
+	p := newTypedPool[T](maxIdle)
+	p.Dial = func(url string) (Closer, error) {
+		c, err := dial(url)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return p
+}
+
+// NewTypedPoolConfig is like NewTypedPool, but dials with the PhysicalShard
+// config like Pool.DialConfig.
+func NewTypedPoolConfig[T Closer](dial func(ctx context.Context, config map[string]interface{}) (T, error), maxIdle int) *TypedPool[T] {
+	p := newTypedPool[T](maxIdle)
+	p.DialConfig = func(ctx context.Context, config map[string]interface{}) (Closer, error) {
+		c, err := dial(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return p
+}
+
+func newTypedPool[T Closer](maxIdle int) *TypedPool[T] {
+	return &TypedPool[T]{&Pool{MaxIdle: maxIdle, connType: reflect.TypeOf((*T)(nil)).Elem()}}
+}
+
+// SetTestOnBorrow sets the pool's TestOnBorrow function to test.
+func (p *TypedPool[T]) SetTestOnBorrow(test func(c T, t time.Time) error) {
+	p.TestOnBorrow = func(c Closer, t time.Time) error {
+		return test(c.(T), t)
+	}
+}
+
+// Get gets a connection from the pool.
+func (p *TypedPool[T]) Get() (*PooledConn[T], error) {
+	return p.GetContext(context.Background())
+}
+
+// GetContext gets a connection from the pool, see Pool.GetContext.
+func (p *TypedPool[T]) GetContext(ctx context.Context) (*PooledConn[T], error) {
+	pc, err := p.Pool.GetContext(ctx)
+	c := &PooledConn[T]{pooledConnection: pc}
+	if err == nil {
+		c.Conn = pc.c.(T)
+	}
+	return c, err
+}
+
+// RegisterTypedPoolType registers a pool type whose connections are of type
+// T, so that PhysicalShards using it reject queries for service methods that
+// take a different connection type.
+func RegisterTypedPoolType[T Closer](name string, pool *TypedPool[T]) {
+	RegisterPoolType(name, pool.Pool)
+}
@@ -0,0 +1,273 @@
+package dilithium_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/cupcake/dilithium"
+	. "launchpad.net/gocheck"
+)
+
+type PoolSuite struct{}
+
+var _ = Suite(&PoolSuite{})
+
+type testConn struct {
+	closed bool
+}
+
+func (c *testConn) Close() {
+	if c.closed {
+		panic("testConn already closed")
+	}
+	c.closed = true
+}
+
+func testDial(url string) (dilithium.Closer, error) {
+	return &testConn{}, nil
+}
+
+func (s *PoolSuite) TestMaxActive(c *C) {
+	p := &dilithium.Pool{Dial: testDial, MaxIdle: 2, MaxActive: 2}
+	c1, err := p.Get()
+	c.Assert(err, IsNil)
+	c2, err := p.Get()
+	c.Assert(err, IsNil)
+
+	c3, err := p.Get()
+	c.Assert(err, Equals, dilithium.ErrPoolExhausted)
+	c3.Close()
+
+	c1.Close()
+	c3, err = p.Get()
+	c.Assert(err, IsNil)
+
+	c2.Close()
+	c3.Close()
+	p.Close()
+}
+
+func (s *PoolSuite) TestWait(c *C) {
+	p := &dilithium.Pool{Dial: testDial, MaxIdle: 1, MaxActive: 1, Wait: true}
+	c1, err := p.Get()
+	c.Assert(err, IsNil)
+
+	done := make(chan error)
+	go func() {
+		c2, err := p.Get()
+		c2.Close()
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		c.Fatal("Get returned before a connection was released")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c1.Close()
+	c.Assert(<-done, IsNil)
+	p.Close()
+}
+
+func (s *PoolSuite) TestWaitClosed(c *C) {
+	p := &dilithium.Pool{Dial: testDial, MaxActive: 1, Wait: true}
+	c1, err := p.Get()
+	c.Assert(err, IsNil)
+
+	done := make(chan error)
+	go func() {
+		_, err := p.Get()
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	p.Close()
+	c.Assert(<-done, NotNil)
+	c1.Close()
+}
+
+func (s *PoolSuite) TestWaitContext(c *C) {
+	p := &dilithium.Pool{Dial: testDial, MaxActive: 1, Wait: true}
+	c1, err := p.Get()
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = p.GetContext(ctx)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+
+	c1.Close()
+	p.Close()
+}
+
+func (s *PoolSuite) TestStats(c *C) {
+	p := &dilithium.Pool{Dial: testDial, MaxIdle: 1, MaxActive: 2}
+	c1, _ := p.Get()
+	c2, _ := p.Get()
+	_, err := p.Get()
+	c.Assert(err, Equals, dilithium.ErrPoolExhausted)
+
+	stats := p.Stats()
+	c.Assert(stats.ActiveCount, Equals, 2)
+	c.Assert(stats.IdleCount, Equals, 0)
+	c.Assert(stats.Dials, Equals, int64(2))
+
+	c1.Close()
+	c2.Close()
+	stats = p.Stats()
+	c.Assert(stats.ActiveCount, Equals, 1)
+	c.Assert(stats.IdleCount, Equals, 1)
+	p.Close()
+}
+
+func (s *PoolSuite) TestIdleReaper(c *C) {
+	p := &dilithium.Pool{Dial: testDial, MaxIdle: 1, IdleTimeout: 10 * time.Millisecond}
+	c1, err := p.Get()
+	c.Assert(err, IsNil)
+	c1.Close()
+	c.Assert(p.Stats().IdleCount, Equals, 1)
+
+	time.Sleep(50 * time.Millisecond)
+	stats := p.Stats()
+	c.Assert(stats.IdleCount, Equals, 0)
+	c.Assert(stats.IdleTimeoutClosed, Equals, int64(1))
+	p.Close()
+}
+
+func (s *PoolSuite) TestMaxConnLifetime(c *C) {
+	p := &dilithium.Pool{Dial: testDial, MaxIdle: 1, MaxConnLifetime: 10 * time.Millisecond}
+	c1, err := p.Get()
+	c.Assert(err, IsNil)
+	time.Sleep(20 * time.Millisecond)
+	c1.Close()
+
+	stats := p.Stats()
+	c.Assert(stats.ActiveCount, Equals, 0)
+	c.Assert(stats.LifetimeClosed, Equals, int64(1))
+	p.Close()
+}
+
+func (s *PoolSuite) TestMinIdle(c *C) {
+	var borrows int32
+	p := &dilithium.Pool{Dial: testDial, MaxIdle: 3, MinIdle: 2}
+	p.TestOnBorrow = func(conn dilithium.Closer, t time.Time) error {
+		if atomic.AddInt32(&borrows, 1) <= 2 {
+			return errors.New("stale")
+		}
+		return nil
+	}
+	c.Assert(p.Warm(context.Background()), IsNil)
+	c.Assert(p.Stats().IdleCount, Equals, 2)
+
+	// connections that fail TestOnBorrow are replaced in the background
+	c1, err := p.Get()
+	c.Assert(err, IsNil)
+	time.Sleep(20 * time.Millisecond)
+	stats := p.Stats()
+	c.Assert(stats.IdleCount, Equals, 2)
+	c.Assert(stats.TestOnBorrowFailures, Equals, int64(2))
+	c1.Close()
+	p.Close()
+}
+
+func (s *PoolSuite) TestBroken(c *C) {
+	errFatal := errors.New("fatal")
+	p := &dilithium.Pool{Dial: testDial, MaxIdle: 2}
+	p.IsFatal = func(err error) bool { return err == errFatal }
+
+	c1, _ := p.Get()
+	c2, _ := p.Get()
+	c3, _ := p.Get()
+	c1.CheckErr(errors.New("not found"))
+	c1.Close()
+	c2.CheckErr(errFatal)
+	c2.Close()
+	c3.MarkBroken()
+	c3.Close()
+
+	stats := p.Stats()
+	c.Assert(stats.IdleCount, Equals, 1)
+	c.Assert(stats.ActiveCount, Equals, 1)
+	c.Assert(stats.BrokenClosed, Equals, int64(2))
+	p.Close()
+}
+
+func (s *PoolSuite) TestCircuitBreaker(c *C) {
+	var down int32 = 1
+	p := &dilithium.Pool{MaxIdle: 1, BreakerThreshold: 2, BreakerBackoff: 20 * time.Millisecond}
+	p.Dial = func(url string) (dilithium.Closer, error) {
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return &testConn{}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := p.Get()
+		c.Assert(err, ErrorMatches, "connection refused")
+	}
+	_, err := p.Get()
+	c.Assert(err, Equals, dilithium.ErrCircuitOpen)
+	c.Assert(p.Stats().CircuitOpen, Equals, true)
+
+	// the probe fails and the circuit reopens
+	time.Sleep(25 * time.Millisecond)
+	_, err = p.Get()
+	c.Assert(err, ErrorMatches, "connection refused")
+	_, err = p.Get()
+	c.Assert(err, Equals, dilithium.ErrCircuitOpen)
+
+	// the probe succeeds after twice the backoff and the circuit closes
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(45 * time.Millisecond)
+	c1, err := p.Get()
+	c.Assert(err, IsNil)
+	c1.Close()
+
+	stats := p.Stats()
+	c.Assert(stats.CircuitOpen, Equals, false)
+	c.Assert(stats.CircuitOpens, Equals, int64(1))
+	c.Assert(stats.CircuitRejects, Equals, int64(2))
+	p.Close()
+}
+
+func (s *PoolSuite) TestDrain(c *C) {
+	p := &dilithium.Pool{Dial: testDial, MaxIdle: 2}
+	c1, _ := p.Get()
+	c2, _ := p.Get()
+	c3, _ := p.Get()
+	c1.Close()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c2.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.Assert(p.Drain(ctx), Equals, 1)
+
+	_, err := p.Get()
+	c.Assert(err, NotNil)
+
+	// closing a connection closed by Drain is a no-op
+	c3.Close()
+	stats := p.Stats()
+	c.Assert(stats.ActiveCount, Equals, 0)
+	c.Assert(stats.ForcedClosed, Equals, int64(1))
+}
+
+func (s *PoolSuite) TestTypedPool(c *C) {
+	p := dilithium.NewTypedPool(func(url string) (*testConn, error) {
+		return &testConn{}, nil
+	}, 1)
+	c1, err := p.Get()
+	c.Assert(err, IsNil)
+	c.Assert(c1.Conn.closed, Equals, false)
+	c1.Close()
+	c.Assert(p.Stats().IdleCount, Equals, 1)
+	p.Close()
+	c.Assert(c1.Conn.closed, Equals, true)
+}
@@ -0,0 +1,219 @@
+package dilithium
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// PrimaryShard sends writes to a single primary child and reads from the
+// others, the secondaries. The primary is the child whose node name is
+// configured as 'primary', the first child by default. Children are named as
+// in a ReplicateShard. Secondaries are picked by 'strategy'
+// like the children of a ReplicateShard, failing over to each other, and to
+// the primary if 'read_fallback' is true. Reads go to the primary if it is
+// the only child.
+//
+// A secondary becomes the primary when promoted with Promote or Server.Promote,
+// or when 'failover_after' consecutive writes to the primary fail. The new
+// primary is reflected in Config. If the primary is removed, writes fail until
+// another child is promoted, while reads go to the remaining children.
+type PrimaryShard struct {
+	baseShard
+	primary       string
+	strategy      readStrategy
+	fallback      bool
+	failoverAfter int64
+	failures      int64 // consecutive failed writes to the primary
+	stats         replicaStats
+}
+
+func (p *PrimaryShard) Setup(config map[string]interface{}) error {
+	var primary string
+	if v, ok := config["primary"]; ok {
+		if primary, ok = v.(string); !ok {
+			return fmt.Errorf("dilithium: Invalid PrimaryShard config 'primary', expecting string, got %T", v)
+		}
+	}
+	var fallback bool
+	if v, ok := config["read_fallback"]; ok {
+		if fallback, ok = v.(bool); !ok {
+			return fmt.Errorf("dilithium: Invalid PrimaryShard config 'read_fallback', expecting bool, got %T", v)
+		}
+	}
+	names, err := parseNodeNames(config, "PrimaryShard")
+	if err != nil {
+		return err
+	}
+	strategy, err := parseReadStrategy(config, &names)
+	if err != nil {
+		return err
+	}
+	failoverAfter, _, err := configInt(config, "failover_after")
+	if err != nil {
+		return fmt.Errorf("dilithium: Invalid PrimaryShard config 'failover_after': %s", err)
+	}
+	downPeriod, ok, err := configDuration(config, "down_period")
+	if err != nil {
+		return fmt.Errorf("dilithium: Invalid PrimaryShard config 'down_period': %s", err)
+	}
+	if !ok {
+		downPeriod = defaultDownPeriod
+	}
+	p.Lock()
+	p.setup(config)
+	p.names = &names
+	p.primary = primary
+	p.strategy = strategy
+	p.fallback = fallback
+	p.failoverAfter = int64(failoverAfter)
+	p.stats.setDownPeriod(downPeriod)
+	p.Unlock()
+	return nil
+}
+
+var errNoPrimaryChildren = errors.New("dilithium: PrimaryShard has no children")
+
+// roles returns the primary and the secondaries. If the configured primary
+// was removed, the primary is nil and every child is a secondary. The caller
+// must hold p's read lock.
+func (p *PrimaryShard) roles() (Shard, []Shard, error) {
+	if len(p.children) == 0 {
+		return nil, nil, errNoPrimaryChildren
+	}
+	primary := p.children[0]
+	if p.primary != "" {
+		primary = p.names.child(p.primary)
+	}
+	secondaries := make([]Shard, 0, len(p.children)-1)
+	for _, s := range p.children {
+		if s != primary {
+			secondaries = append(secondaries, s)
+		}
+	}
+	return primary, secondaries, nil
+}
+
+func (p *PrimaryShard) Query(ctx context.Context, q *Query) error {
+	p.RLock()
+	primary, secondaries, err := p.roles()
+	name, strategy, fallback := p.primary, p.strategy, p.fallback
+	p.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if !q.ReadOnly() {
+		if primary == nil {
+			return fmt.Errorf("dilithium: PrimaryShard primary '%s' is not a child", name)
+		}
+		err := primary.Query(ctx, q)
+		p.stats.recordWrite(primary.ID(), err)
+		p.checkFailover(ctx, primary.ID(), err)
+		return err
+	}
+
+	var errs []ChildError
+	tried := make(map[Shard]bool, len(secondaries))
+	for len(tried) < len(secondaries) && ctx.Err() == nil {
+		var candidates []Shard
+		for _, s := range secondaries {
+			if !tried[s] {
+				candidates = append(candidates, s)
+			}
+		}
+		s := strategy.pick(candidates, &p.stats)
+		tried[s] = true
+		if err := p.read(ctx, s, q); err != nil {
+			errs = append(errs, ChildError{s.ID(), err})
+			continue
+		}
+		return nil
+	}
+	if (fallback || len(secondaries) == 0) && primary != nil && ctx.Err() == nil {
+		if err := p.read(ctx, primary, q); err != nil {
+			errs = append(errs, ChildError{primary.ID(), err})
+		} else {
+			return nil
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return ctx.Err()
+	case 1:
+		return errs[0].Err
+	}
+	return &ReadError{errs}
+}
+
+func (p *PrimaryShard) read(ctx context.Context, s Shard, q *Query) error {
+	id := s.ID()
+	p.stats.startRead(id, false)
+	start := time.Now()
+	err := s.Query(ctx, q)
+	if err != nil && ctx.Err() != nil {
+		// the caller gave up, which says nothing about the child
+		p.stats.abandonRead(id)
+	} else {
+		p.stats.finishRead(id, time.Since(start), err)
+	}
+	return err
+}
+
+// checkFailover counts the consecutive failed writes to the primary and
+// promotes a secondary after 'failover_after' of them. Writes cancelled by
+// the caller are not counted.
+func (p *PrimaryShard) checkFailover(ctx context.Context, primary string, err error) {
+	if err == nil {
+		atomic.StoreInt64(&p.failures, 0)
+		return
+	}
+	if ctx.Err() != nil || p.failoverAfter == 0 || atomic.AddInt64(&p.failures, 1) < p.failoverAfter {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if current, _, _ := p.roles(); current == nil || current.ID() != primary {
+		// promoted concurrently
+		return
+	}
+	for _, s := range p.children {
+		if id := s.ID(); id != primary && !p.stats.down(id) {
+			log.Printf("dilithium: PrimaryShard primary '%s' failed %d writes, last error: %s", primary, p.failoverAfter, err)
+			p.promote(s)
+			return
+		}
+	}
+	log.Printf("dilithium: PrimaryShard primary '%s' failed %d writes, no secondary to promote", primary, p.failoverAfter)
+}
+
+// Promote makes the child with the given ID the primary.
+func (p *PrimaryShard) Promote(id string) error {
+	p.Lock()
+	defer p.Unlock()
+	s := p.child(id)
+	if s == nil {
+		return fmt.Errorf("dilithium: PrimaryShard has no child '%s'", id)
+	}
+	p.promote(s)
+	return nil
+}
+
+// promote makes child s the primary and records its node name in the shard's
+// config. The caller must hold p's lock.
+func (p *PrimaryShard) promote(s Shard) {
+	name := p.names.name(s)
+	p.config = withConfig(p.config, "primary", name)
+	p.primary = name
+	atomic.StoreInt64(&p.failures, 0)
+	log.Printf("dilithium: PrimaryShard promoted '%s' to primary", name)
+}
+
+// Stats returns the statistics of the shard's children, keyed by child ID.
+func (p *PrimaryShard) Stats() map[string]ReplicaStats {
+	return p.stats.snapshot()
+}
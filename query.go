@@ -1,8 +1,10 @@
 package dilithium
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"time"
 )
 
 type QueryArg interface {
@@ -10,28 +12,53 @@ type QueryArg interface {
 }
 
 type Query struct {
-	Method  string
-	Arg     QueryArg
-	Reply   interface{}
-	server  *rpcServer
-	service *service
-	method  *methodType
+	Method string
+	Arg    QueryArg
+	Reply  interface{}
+	// Timeout bounds the time the server spends routing and running the
+	// query. If zero, the query runs until the datastore answers.
+	Timeout time.Duration
+	// ServedBy is set to the ID of the PhysicalShard that answered a
+	// read-only query.
+	ServedBy string
+	// fillReply is passed to read methods instead of a new reply, so that
+	// CacheShard fill methods receive the value to store.
+	fillReply interface{}
+	server    *rpcServer
+	service   *service
+	method    *methodType
+}
+
+// clone returns a copy of q that can be run concurrently with q.
+func (q *Query) clone() *Query {
+	c := *q
+	c.Reply = nil
+	c.ServedBy = ""
+	return &c
 }
 
 func (q *Query) ReadOnly() bool {
 	return q.method.readOnly
 }
 
-func (q *Query) Route() error {
+func (q *Query) Route(ctx context.Context) error {
 	key := q.Arg.ShardKey()
 	shard := q.server.forwarding.Lookup(key)
 	if shard == nil {
 		return fmt.Errorf("dilithium: could not find shard for key: %d", key)
 	}
-	return shard.Query(q)
+	return shard.Query(ctx, q)
 }
 
-func (q *Query) Run(conn interface{}) error {
+// Run calls the query's service method with conn. Methods that take a
+// context.Context receive ctx and may use it to abort the datastore call.
+func (q *Query) Run(ctx context.Context, conn interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := q.checkConnType(reflect.TypeOf(conn)); err != nil {
+		return err
+	}
 	f := q.method.method.Func
 
 	arg := reflect.ValueOf(q.Arg)
@@ -45,17 +72,32 @@ func (q *Query) Run(conn interface{}) error {
 		}
 	}
 
-	var res []reflect.Value
+	in := []reflect.Value{q.service.rcvr}
+	if q.method.takesContext {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	in = append(in, reflect.ValueOf(conn), arg)
 	if q.ReadOnly() {
 		reply := reflect.New(q.method.ReplyType)
+		if q.fillReply != nil {
+			reply = reflect.ValueOf(q.fillReply)
+		}
 		q.Reply = reply.Interface()
-		res = f.Call([]reflect.Value{q.service.rcvr, reflect.ValueOf(conn), arg, reply})
-	} else {
-		res = f.Call([]reflect.Value{q.service.rcvr, reflect.ValueOf(conn), arg})
+		in = append(in, reply)
 	}
+	res := f.Call(in)
 	resErr := res[0].Interface()
 	if resErr != nil {
 		return resErr.(error)
 	}
 	return nil
 }
+
+// checkConnType returns an error if connections of type t cannot be passed to
+// the query's service method.
+func (q *Query) checkConnType(t reflect.Type) error {
+	if t == nil || !t.AssignableTo(q.method.ConnType) {
+		return fmt.Errorf("dilithium: %s expects connection of type %s, got %s", q.Method, q.method.ConnType, t)
+	}
+	return nil
+}
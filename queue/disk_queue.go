@@ -25,6 +25,15 @@ type Queue interface {
 	Empty() error
 }
 
+// AckQueue is a Queue whose read position only advances when the message
+// last received from ReadChan is acknowledged. No other message is received
+// until then, and an unacknowledged message is received again after a
+// restart.
+type AckQueue interface {
+	Queue
+	Ack() error
+}
+
 // DiskQueue implements the Queue interface
 // providing a filesystem backed FIFO queue
 type DiskQueue struct {
@@ -62,6 +71,8 @@ type DiskQueue struct {
 	writeResponseChan chan error
 	emptyChan         chan int
 	emptyResponseChan chan error
+	ackChan           chan int // nil unless acknowledgements are required
+	ackResponseChan   chan error
 	exitChan          chan int
 	exitSyncChan      chan int
 }
@@ -69,6 +80,15 @@ type DiskQueue struct {
 // NewDiskQueue instantiates a new instance of DiskQueue, retrieving metadata
 // from the filesystem and starting the read ahead goroutine
 func NewDiskQueue(name string, dataPath string, maxBytesPerFile int64, syncEvery int64) Queue {
+	return newDiskQueue(name, dataPath, maxBytesPerFile, syncEvery, false)
+}
+
+// NewAckDiskQueue instantiates a DiskQueue implementing AckQueue
+func NewAckDiskQueue(name string, dataPath string, maxBytesPerFile int64, syncEvery int64) AckQueue {
+	return newDiskQueue(name, dataPath, maxBytesPerFile, syncEvery, true)
+}
+
+func newDiskQueue(name string, dataPath string, maxBytesPerFile int64, syncEvery int64, ack bool) *DiskQueue {
 	d := DiskQueue{
 		name:              name,
 		dataPath:          dataPath,
@@ -82,6 +102,10 @@ func NewDiskQueue(name string, dataPath string, maxBytesPerFile int64, syncEvery
 		exitSyncChan:      make(chan int),
 		syncEvery:         syncEvery,
 	}
+	if ack {
+		d.ackChan = make(chan int)
+		d.ackResponseChan = make(chan error)
+	}
 
 	// no need to lock here, nothing else could possibly be touching this instance
 	err := d.retrieveMetaData()
@@ -104,7 +128,25 @@ func (d *DiskQueue) ReadChan() chan []byte {
 	return d.readChan
 }
 
-// Put writes a []byte to the queue
+// Ack advances the read position past the message last received from
+// ReadChan, for queues created with NewAckDiskQueue
+func (d *DiskQueue) Ack() error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.ackChan == nil {
+		return errors.New("not an ack queue")
+	}
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.ackChan <- 1
+	return <-d.ackResponseChan
+}
+
+// Put writes a []byte to the queue. With a syncEvery of 1, the write is
+// synced before Put returns
 func (d *DiskQueue) Put(data []byte) error {
 	d.RLock()
 	defer d.RUnlock()
@@ -405,6 +447,32 @@ func (d *DiskQueue) fileName(fileNum int64) string {
 	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.%06d.dat"), d.name, fileNum)
 }
 
+// advance moves the read position past the message sent over readChan
+func (d *DiskQueue) advance() error {
+	oldReadFileNum := d.readFileNum
+	d.readFileNum = d.nextReadFileNum
+	d.readPos = d.nextReadPos
+	atomic.AddInt64(&d.depth, -1)
+
+	// see if we need to clean up the old file
+	if oldReadFileNum != d.nextReadFileNum {
+		// sync every time we start reading from a new file
+		err := d.sync()
+		if err != nil {
+			log.Printf("ERROR: diskqueue(%s) failed to sync - %s", d.name, err.Error())
+			return err
+		}
+
+		// only if we've successfully synced do we remove old files
+		fn := d.fileName(oldReadFileNum)
+		err = os.Remove(fn)
+		if err != nil {
+			log.Printf("ERROR: failed to Remove(%s) - %s", fn, err.Error())
+		}
+	}
+	return nil
+}
+
 // ioLoop provides the backend for exposing a go channel (via ReadChan())
 // in support of multiple concurrent queue consumers
 //
@@ -418,19 +486,24 @@ func (d *DiskQueue) ioLoop() {
 	var err error
 	var count int64
 	var r chan []byte
+	var unacked bool // a message was sent and not acknowledged yet
+	var synced bool  // the last write was synced before responding
 
 	for {
 		count++
 		// dont sync all the time :)
 		if count == d.syncEvery {
-			err := d.sync()
-			if err != nil {
-				log.Printf("ERROR: diskqueue(%s) failed to sync - %s", d.name, err.Error())
+			if !synced {
+				err := d.sync()
+				if err != nil {
+					log.Printf("ERROR: diskqueue(%s) failed to sync - %s", d.name, err.Error())
+				}
 			}
 			count = 0
 		}
+		synced = false
 
-		if (d.readFileNum < d.writeFileNum) || (d.readPos < d.writePos) {
+		if !unacked && ((d.readFileNum < d.writeFileNum) || (d.readPos < d.writePos)) {
 			if d.nextReadPos == d.readPos {
 				dataRead, err = d.readOne()
 				if err != nil {
@@ -479,31 +552,30 @@ func (d *DiskQueue) ioLoop() {
 		// the Go channel spec dictates that nil channel operations (read or write)
 		// in a select are skipped, we set r to d.readChan only when there is data to read
 		case r <- dataRead:
-			oldReadFileNum := d.readFileNum
-			d.readFileNum = d.nextReadFileNum
-			d.readPos = d.nextReadPos
-			atomic.AddInt64(&d.depth, -1)
-
-			// see if we need to clean up the old file
-			if oldReadFileNum != d.nextReadFileNum {
-				// sync every time we start reading from a new file
-				err = d.sync()
-				if err != nil {
-					log.Printf("ERROR: diskqueue(%s) failed to sync - %s", d.name, err.Error())
-					continue
-				}
-
-				// only if we've successfully synced do we remove old files
-				fn := d.fileName(oldReadFileNum)
-				err = os.Remove(fn)
-				if err != nil {
-					log.Printf("ERROR: failed to Remove(%s) - %s", fn, err.Error())
-				}
+			if d.ackChan != nil {
+				unacked = true
+				continue
+			}
+			d.advance()
+		case <-d.ackChan:
+			if !unacked {
+				d.ackResponseChan <- errors.New("no message to ack")
+				continue
 			}
+			unacked = false
+			d.ackResponseChan <- d.advance()
 		case <-d.emptyChan:
+			unacked = false
 			d.emptyResponseChan <- d.doEmpty()
 		case dataWrite := <-d.writeChan:
-			d.writeResponseChan <- d.writeOne(dataWrite)
+			err := d.writeOne(dataWrite)
+			if err == nil && d.syncEvery == 1 {
+				// sync before responding, so that the write is durable
+				// once Put returns
+				err = d.sync()
+				synced = true
+			}
+			d.writeResponseChan <- err
 		case <-d.exitChan:
 			goto exit
 		}
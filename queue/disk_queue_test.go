@@ -31,6 +31,35 @@ func TestDiskQueue(t *testing.T) {
 	assert.Equal(t, msgOut, msg)
 }
 
+func TestDiskQueueAck(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dqName := "test_disk_queue_ack" + strconv.Itoa(int(time.Now().Unix()))
+	dq := NewAckDiskQueue(dqName, os.TempDir(), 1024, 1)
+	assert.Equal(t, dq.Put([]byte("a")), nil)
+	assert.Equal(t, dq.Put([]byte("b")), nil)
+	assert.Equal(t, <-dq.ReadChan(), []byte("a"))
+
+	// nothing else is read until the message is acknowledged
+	select {
+	case <-dq.ReadChan():
+		t.Fatal("read a message before the ack")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.Equal(t, dq.Depth(), int64(2))
+	dq.Close()
+
+	// and it is read again after a restart
+	dq = NewAckDiskQueue(dqName, os.TempDir(), 1024, 1)
+	assert.Equal(t, <-dq.ReadChan(), []byte("a"))
+	assert.Equal(t, dq.Ack(), nil)
+	assert.Equal(t, <-dq.ReadChan(), []byte("b"))
+	assert.Equal(t, dq.Ack(), nil)
+	assert.Equal(t, dq.Depth(), int64(0))
+	dq.Close()
+}
+
 func TestDiskQueueRoll(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
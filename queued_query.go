@@ -0,0 +1,213 @@
+package dilithium
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cupcake/dilithium/queue"
+)
+
+// queuedQuery is a write query persisted to a DiskQueue, used for hinted
+// handoff and write-behind.
+type queuedQuery struct {
+	Method string
+	Arg    []byte    // gob-encoded query argument
+	Time   time.Time // when the query was queued
+}
+
+// DiskQueue settings for queued queries. Every write is synced before Put
+// returns, as queued queries have been acknowledged or failed over.
+const (
+	queueMaxBytesPerFile = 16 << 20
+	queueSyncEvery       = 1
+	defaultQueueRetry    = time.Second
+)
+
+var errNoServer = errors.New("dilithium: no server to resolve the method with")
+
+// queuePaths holds the queue paths claimed by shards, as shards sharing
+// DiskQueue files would corrupt each other's queues.
+var queuePaths = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// claimQueuePath reserves path until it is released with releaseQueuePath. It
+// returns false if path is already claimed.
+func claimQueuePath(path string) bool {
+	path = absPath(path)
+	queuePaths.Lock()
+	defer queuePaths.Unlock()
+	if queuePaths.m[path] {
+		return false
+	}
+	queuePaths.m[path] = true
+	return true
+}
+
+func releaseQueuePath(path string) {
+	path = absPath(path)
+	queuePaths.Lock()
+	delete(queuePaths.m, path)
+	queuePaths.Unlock()
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// encodeQuery encodes q for a DiskQueue.
+func encodeQuery(q *Query) ([]byte, error) {
+	var arg, data bytes.Buffer
+	if err := gob.NewEncoder(&arg).Encode(q.Arg); err != nil {
+		return nil, err
+	}
+	if err := gob.NewEncoder(&data).Encode(queuedQuery{q.Method, arg.Bytes(), nowFunc()}); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// decodeQuery decodes a query encoded by encodeQuery, resolving its method
+// with server. It also returns the time the query was queued.
+func decodeQuery(server *rpcServer, data []byte) (*Query, time.Time, error) {
+	var qq queuedQuery
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&qq); err != nil {
+		return nil, time.Time{}, err
+	}
+	if server == nil {
+		return nil, qq.Time, errNoServer
+	}
+	q := &Query{Method: qq.Method}
+	if err := server.resolve(q); err != nil {
+		return nil, qq.Time, err
+	}
+	arg := reflect.New(q.method.ArgType)
+	if err := gob.NewDecoder(bytes.NewReader(qq.Arg)).Decode(arg.Interface()); err != nil {
+		return nil, qq.Time, err
+	}
+	q.Arg = arg.Elem().Interface().(QueryArg)
+	return q, qq.Time, nil
+}
+
+// queueReplayer applies the queries of an AckQueue in order. A query is only
+// acknowledged once it is done with, so that it is applied first after a
+// restart instead of being lost or reordered.
+//
+// Queries are resolved by the server the owner last received a query from.
+// Until there is one, the replayer waits without counting attempts. Queries
+// that cannot be decoded or resolved are given up on without retrying.
+type queueReplayer struct {
+	queue       queue.AckQueue
+	retry       time.Duration
+	maxAttempts int // unlimited if zero
+	server      *atomic.Pointer[rpcServer]
+
+	// apply runs a decoded query. Failed queries are retried every retry.
+	apply func(q *Query) error
+	// begin, if set, is called with the time a query was queued before
+	// applying it.
+	begin func(queued time.Time)
+	// fail, if set, is called with the error of each failed attempt.
+	fail func(err error)
+	// finish is called once a query is applied, with a nil error, or given
+	// up on.
+	finish func(data []byte, err error)
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newQueueReplayer opens the queue called name in dir. The caller sets the
+// callbacks and calls start.
+func newQueueReplayer(dir, name string, retry time.Duration, maxAttempts int, server *atomic.Pointer[rpcServer]) *queueReplayer {
+	return &queueReplayer{
+		queue:       queue.NewAckDiskQueue(name, dir, queueMaxBytesPerFile, queueSyncEvery),
+		retry:       retry,
+		maxAttempts: maxAttempts,
+		server:      server,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+func (r *queueReplayer) start() {
+	go r.loop()
+}
+
+// depth returns the number of queries not done with yet.
+func (r *queueReplayer) depth() int64 {
+	return r.queue.Depth()
+}
+
+func (r *queueReplayer) loop() {
+	defer close(r.done)
+	for {
+		select {
+		case data := <-r.queue.ReadChan():
+			if !r.replay(data) {
+				return
+			}
+			if err := r.queue.Ack(); err != nil {
+				log.Printf("dilithium: failed to acknowledge queued query: %s", err)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// replay applies a query until it is done with. It returns false if the
+// replayer is stopped first, leaving the query unacknowledged.
+func (r *queueReplayer) replay(data []byte) bool {
+	var began bool
+	for attempt := 0; ; {
+		q, queued, err := decodeQuery(r.server.Load(), data)
+		if !began && !queued.IsZero() && r.begin != nil {
+			r.begin(queued)
+			began = true
+		}
+		switch {
+		case err == errNoServer:
+			// wait for the first query without counting an attempt
+		case err != nil:
+			r.finish(data, err)
+			return true
+		default:
+			if err = r.apply(q); err == nil {
+				r.finish(data, nil)
+				return true
+			}
+			if attempt++; r.maxAttempts > 0 && attempt >= r.maxAttempts {
+				r.finish(data, err)
+				return true
+			}
+			if r.fail != nil {
+				r.fail(err)
+			}
+		}
+		select {
+		case <-time.After(r.retry):
+		case <-r.stop:
+			return false
+		}
+	}
+}
+
+// close stops the replayer and closes the queue, keeping the queries not done
+// with on disk.
+func (r *queueReplayer) close() error {
+	close(r.stop)
+	<-r.done
+	return r.queue.Close()
+}
@@ -0,0 +1,129 @@
+package dilithium
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// RangeShard partitions keys across its children by range, like the
+// ForwardingTable. The 'max_keys' list holds the maximum key of each child,
+// in child order. A key is routed to the child with the lowest maximum key
+// that is greater or equal to it.
+type RangeShard struct {
+	baseShard
+	maxKeys []int // aligned with children
+	order   []int // indexes of maxKeys in ascending order
+}
+
+func (r *RangeShard) Setup(config map[string]interface{}) error {
+	v, ok := config["max_keys"]
+	list, isList := v.([]interface{})
+	if !ok || !isList {
+		return fmt.Errorf("dilithium: Invalid RangeShard config 'max_keys', expecting list, got %T", v)
+	}
+	maxKeys := make([]int, len(list))
+	seen := make(map[int]bool, len(list))
+	for i, v := range list {
+		k, err := toInt(v)
+		if err != nil {
+			return fmt.Errorf("dilithium: Invalid RangeShard config 'max_keys': %s", err)
+		}
+		if seen[k] {
+			return fmt.Errorf("dilithium: Invalid RangeShard config 'max_keys', duplicate max key %d", k)
+		}
+		seen[k] = true
+		maxKeys[i] = k
+	}
+	r.Lock()
+	r.setup(config)
+	r.maxKeys = maxKeys
+	r.sortKeys()
+	r.Unlock()
+	return nil
+}
+
+// AddRangeChild adds a child that serves keys up to maxKey and records the
+// boundary in the shard's config. Children added with AddChild take the next
+// boundary from 'max_keys'.
+func (r *RangeShard) AddRangeChild(maxKey int, s Shard) error {
+	r.Lock()
+	defer r.Unlock()
+	for _, k := range r.maxKeys {
+		if k == maxKey {
+			return fmt.Errorf("dilithium: RangeShard already has a child with max key %d", maxKey)
+		}
+	}
+	// children added with AddChild may still be missing their boundary
+	if len(r.children) < len(r.maxKeys) {
+		return fmt.Errorf("dilithium: RangeShard has %d children for %d max keys", len(r.children), len(r.maxKeys))
+	}
+	r.children = append(r.children, s)
+	r.maxKeys = append(r.maxKeys, maxKey)
+	r.updateConfig()
+	return nil
+}
+
+func (r *RangeShard) RemoveChild(id string) {
+	r.Lock()
+	i, s := r.removeChild(id)
+	if s != nil && i < len(r.maxKeys) {
+		r.maxKeys = append(r.maxKeys[:i:i], r.maxKeys[i+1:]...)
+		r.updateConfig()
+	}
+	r.Unlock()
+	destroyChild(s)
+}
+
+// updateConfig records the current boundaries in the shard's config. The
+// caller must hold r's lock.
+func (r *RangeShard) updateConfig() {
+	r.sortKeys()
+	config := make(map[string]interface{}, len(r.config))
+	for k, v := range r.config {
+		config[k] = v
+	}
+	maxKeys := make([]interface{}, len(r.maxKeys))
+	for i, k := range r.maxKeys {
+		maxKeys[i] = float64(k)
+	}
+	config["max_keys"] = maxKeys
+	r.config = config
+}
+
+// lookup returns the child serving key, or nil. The caller must hold r's read
+// lock.
+func (r *RangeShard) lookup(key int) (Shard, error) {
+	if len(r.children) != len(r.maxKeys) {
+		return nil, fmt.Errorf("dilithium: RangeShard has %d children for %d max keys", len(r.children), len(r.maxKeys))
+	}
+	i := sort.Search(len(r.order), func(i int) bool { return r.maxKeys[r.order[i]] >= key })
+	if i == len(r.order) {
+		return nil, nil
+	}
+	return r.children[r.order[i]], nil
+}
+
+// sortKeys orders the boundaries. The caller must hold r's lock.
+func (r *RangeShard) sortKeys() {
+	order := make([]int, len(r.maxKeys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return r.maxKeys[order[i]] < r.maxKeys[order[j]] })
+	r.order = order
+}
+
+func (r *RangeShard) Query(ctx context.Context, q *Query) error {
+	key := q.Arg.ShardKey()
+	r.RLock()
+	s, err := r.lookup(key)
+	r.RUnlock()
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("dilithium: could not find shard for key: %d", key)
+	}
+	return s.Query(ctx, q)
+}
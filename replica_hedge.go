@@ -0,0 +1,80 @@
+package dilithium
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// hedgePolicy decides when a ReplicateShard sends a read to a second child
+// while the first has not answered yet.
+type hedgePolicy struct {
+	delay time.Duration
+	p95   bool
+}
+
+// parseHedgePolicy parses the 'hedge_delay' config key, which is either a
+// duration or "p95" to hedge after the 95th percentile of recent read
+// latencies. Hedging is disabled if the key is missing.
+func parseHedgePolicy(config map[string]interface{}) (hedgePolicy, error) {
+	if config["hedge_delay"] == "p95" {
+		return hedgePolicy{p95: true}, nil
+	}
+	d, _, err := configDuration(config, "hedge_delay")
+	if err != nil {
+		return hedgePolicy{}, fmt.Errorf("dilithium: Invalid ReplicateShard config 'hedge_delay': %s", err)
+	}
+	if d < 0 {
+		return hedgePolicy{}, fmt.Errorf("dilithium: Invalid ReplicateShard config 'hedge_delay', expecting positive duration, got %s", d)
+	}
+	return hedgePolicy{delay: d}, nil
+}
+
+// after returns the time to wait for a read before hedging, or 0 if the read
+// should not be hedged.
+func (h hedgePolicy) after(stats *replicaStats) time.Duration {
+	if h.p95 {
+		return stats.percentile(0.95)
+	}
+	return h.delay
+}
+
+const (
+	// latencyWindow is the number of recent read latencies kept to compute
+	// percentiles.
+	latencyWindow = 100
+	// minLatencySamples is the number of samples needed before percentiles
+	// are reported.
+	minLatencySamples = 20
+)
+
+// latencies is a ring buffer of recent read latencies.
+type latencies struct {
+	samples [latencyWindow]time.Duration
+	n       int
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.samples[l.n%latencyWindow] = d
+	l.n++
+}
+
+// percentile returns the p-th percentile of the recent successful read
+// latencies across all children, or 0 if there are too few samples.
+func (s *replicaStats) percentile(p float64) time.Duration {
+	s.mu.Lock()
+	n := s.latencies.n
+	if n > latencyWindow {
+		n = latencyWindow
+	}
+	if n < minLatencySamples {
+		s.mu.Unlock()
+		return 0
+	}
+	samples := make([]time.Duration, n)
+	copy(samples, s.latencies.samples[:n])
+	s.mu.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[int(p*float64(n-1))]
+}
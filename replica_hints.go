@@ -0,0 +1,170 @@
+package dilithium
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+var errHintPending = errors.New("dilithium: write queued behind pending hints")
+
+// hintConfig configures the hinted handoff of a ReplicateShard.
+type hintConfig struct {
+	path        string
+	retry       time.Duration
+	maxAttempts int
+}
+
+// parseHintConfig parses the 'hint_path', 'hint_retry' and
+// 'hint_max_attempts' config keys. Hinted handoff is disabled if 'hint_path'
+// is missing.
+func parseHintConfig(config map[string]interface{}) (hintConfig, error) {
+	v, ok := config["hint_path"]
+	if !ok {
+		return hintConfig{}, nil
+	}
+	path, ok := v.(string)
+	if !ok {
+		return hintConfig{}, fmt.Errorf("dilithium: Invalid ReplicateShard config 'hint_path', expecting string, got %T", v)
+	}
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		return hintConfig{}, fmt.Errorf("dilithium: Invalid ReplicateShard config 'hint_path', %s is not a directory", path)
+	}
+	retry, ok, err := configDuration(config, "hint_retry")
+	if err != nil {
+		return hintConfig{}, fmt.Errorf("dilithium: Invalid ReplicateShard config 'hint_retry': %s", err)
+	}
+	if !ok {
+		retry = defaultQueueRetry
+	}
+	maxAttempts, _, err := configInt(config, "hint_max_attempts")
+	if err != nil {
+		return hintConfig{}, fmt.Errorf("dilithium: Invalid ReplicateShard config 'hint_max_attempts': %s", err)
+	}
+	return hintConfig{path, retry, maxAttempts}, nil
+}
+
+// hintQueue persists the writes a child failed to apply and replays them in
+// order. Writes that arrive while hints are pending are queued behind them.
+type hintQueue struct {
+	child    Shard
+	replayer *queueReplayer
+	timeout  time.Duration
+	stats    *replicaStats
+
+	mu      sync.Mutex
+	pending int64         // hints queued or being replayed
+	last    chan struct{} // closed when the last reserved write is done
+}
+
+// hintTurn is the place of a write in the order of the writes to a child.
+type hintTurn struct {
+	wait <-chan struct{} // closed when the previous write is done
+	done chan struct{}
+}
+
+// newHintQueue opens the hint queue of child, named after its node name, and
+// starts replaying the hints left by a previous run. The caller must hold r's
+// lock.
+func newHintQueue(r *ReplicateShard, child Shard, name string) *hintQueue {
+	replayer := newQueueReplayer(r.hintConfig.path, "hints."+url.QueryEscape(name), r.hintConfig.retry, r.hintConfig.maxAttempts, &r.server)
+	h := &hintQueue{
+		child:    child,
+		replayer: replayer,
+		timeout:  r.childTimeout,
+		stats:    &r.stats,
+		pending:  replayer.depth(),
+	}
+	replayer.apply = h.run
+	replayer.finish = h.finish
+	replayer.start()
+	return h
+}
+
+func (h *hintQueue) depth() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.pending
+}
+
+// reserve takes the next place in the order of the writes to the child. It is
+// called before the write is started, as a failed write is only queued once
+// the child has answered.
+func (h *hintQueue) reserve() hintTurn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t := hintTurn{wait: h.last, done: make(chan struct{})}
+	h.last = t.done
+	return t
+}
+
+// write runs q on the child once the writes reserved before it are done. If
+// the child fails or has pending hints, q is persisted as a hint and the
+// write is reported as failed.
+func (h *hintQueue) write(ctx context.Context, q *Query, t hintTurn) error {
+	if t.wait != nil {
+		<-t.wait
+	}
+	defer close(t.done)
+	var err error
+	if h.depth() > 0 {
+		err = errHintPending
+	} else if err = h.child.Query(ctx, q); err == nil {
+		return nil
+	}
+	if perr := h.put(q); perr != nil {
+		log.Printf("dilithium: failed to persist hint for '%s': %s", h.child.ID(), perr)
+	}
+	return err
+}
+
+func (h *hintQueue) put(q *Query) error {
+	data, err := encodeQuery(q)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.replayer.queue.Put(data); err != nil {
+		return err
+	}
+	h.pending++
+	return nil
+}
+
+// run runs a hint on the child.
+func (h *hintQueue) run(q *Query) error {
+	ctx := context.Background()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	err := h.child.Query(ctx, q)
+	h.stats.recordWrite(h.child.ID(), err)
+	return err
+}
+
+// finish drops a hint once it is replayed or has failed 'hint_max_attempts'
+// times.
+func (h *hintQueue) finish(data []byte, err error) {
+	if err != nil {
+		log.Printf("dilithium: dropping hint for '%s': %s", h.child.ID(), err)
+	}
+	h.mu.Lock()
+	h.pending--
+	h.mu.Unlock()
+}
+
+// close stops the replay and closes the queue, keeping the pending hints on
+// disk.
+func (h *hintQueue) close() {
+	if err := h.replayer.close(); err != nil {
+		log.Printf("dilithium: failed to close hint queue for '%s': %s", h.child.ID(), err)
+	}
+}
@@ -0,0 +1,168 @@
+package dilithium
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// readStrategy picks the child of a ReplicateShard or PrimaryShard that serves
+// a read.
+type readStrategy interface {
+	pick(children []Shard, stats *replicaStats) Shard
+}
+
+// parseReadStrategy returns the strategy configured with the 'strategy' key of
+// a shard config: "random" (the default), "round_robin",
+// "least_outstanding", "latency" or "weighted". The weighted strategy reads
+// the weight of each child from the 'weights' object, keyed by the child's
+// node name (see nodeNames). Children without a weight have a weight of 1.
+func parseReadStrategy(config map[string]interface{}, names *nodeNames) (readStrategy, error) {
+	v, ok := config["strategy"]
+	if !ok {
+		return randomStrategy{}, nil
+	}
+	name, _ := v.(string)
+	switch name {
+	case "random":
+		return randomStrategy{}, nil
+	case "round_robin":
+		return &roundRobinStrategy{}, nil
+	case "least_outstanding":
+		return leastOutstandingStrategy{}, nil
+	case "latency":
+		return latencyStrategy{}, nil
+	case "weighted":
+		weights, ok := config["weights"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("dilithium: Invalid ReplicateShard config 'weights', expecting object, got %T", config["weights"])
+		}
+		w := &weightedStrategy{weights: make(map[string]float64, len(weights)), names: names}
+		for name, v := range weights {
+			f, ok := v.(float64)
+			if !ok || f < 0 {
+				return nil, fmt.Errorf("dilithium: Invalid ReplicateShard config 'weights' for child '%s', expecting non-negative number, got %v", name, v)
+			}
+			w.weights[name] = f
+		}
+		return w, nil
+	}
+	return nil, fmt.Errorf("dilithium: Invalid ReplicateShard config 'strategy', expecting random, round_robin, least_outstanding, latency or weighted, got %v", v)
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) pick(children []Shard, stats *replicaStats) Shard {
+	return children[rand.Intn(len(children))]
+}
+
+type roundRobinStrategy struct {
+	next uint64
+}
+
+func (s *roundRobinStrategy) pick(children []Shard, stats *replicaStats) Shard {
+	n := atomic.AddUint64(&s.next, 1) - 1
+	return children[n%uint64(len(children))]
+}
+
+// leastOutstandingStrategy picks the child with the fewest reads in flight,
+// breaking ties at random.
+type leastOutstandingStrategy struct{}
+
+func (leastOutstandingStrategy) pick(children []Shard, stats *replicaStats) Shard {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	var best Shard
+	var min int64
+	var ties int
+	for _, c := range children {
+		o := stats.child(c.ID()).Outstanding
+		switch {
+		case best == nil || o < min:
+			best, min, ties = c, o, 1
+		case o == min:
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = c
+			}
+		}
+	}
+	return best
+}
+
+// latencyStrategy picks a child at random with a probability inversely
+// proportional to its average read latency. Children that have not served a
+// read yet are picked first, so that they get measured. Children whose reads
+// all failed are weighted like the slowest child.
+type latencyStrategy struct{}
+
+func (latencyStrategy) pick(children []Shard, stats *replicaStats) Shard {
+	latencies := make([]time.Duration, len(children))
+	var unmeasured []Shard
+	var max time.Duration
+	stats.mu.Lock()
+	for i, c := range children {
+		cs := stats.child(c.ID())
+		if cs.Reads == 0 && cs.Outstanding == 0 {
+			unmeasured = append(unmeasured, c)
+		}
+		latencies[i] = cs.Latency
+		if cs.Latency > max {
+			max = cs.Latency
+		}
+	}
+	stats.mu.Unlock()
+	if len(unmeasured) > 0 {
+		return unmeasured[rand.Intn(len(unmeasured))]
+	}
+	return pickWeighted(children, func(i int) float64 {
+		l := latencies[i]
+		if l == 0 {
+			l = max
+		}
+		if l == 0 {
+			return 1
+		}
+		return 1 / float64(l)
+	})
+}
+
+// weightedStrategy picks a child at random with a probability proportional to
+// its configured weight, keyed by node name. The names are read under the
+// lock of the shard that owns them, which is held while picking.
+type weightedStrategy struct {
+	weights map[string]float64
+	names   *nodeNames
+}
+
+func (w *weightedStrategy) pick(children []Shard, stats *replicaStats) Shard {
+	return pickWeighted(children, func(i int) float64 {
+		if f, ok := w.weights[w.names.name(children[i])]; ok {
+			return f
+		}
+		return 1
+	})
+}
+
+// pickWeighted picks a child at random with a probability proportional to its
+// weight. If all weights are zero, it picks uniformly.
+func pickWeighted(children []Shard, weight func(i int) float64) Shard {
+	weights := make([]float64, len(children))
+	var total float64
+	for i := range children {
+		weights[i] = weight(i)
+		total += weights[i]
+	}
+	if total == 0 {
+		return children[rand.Intn(len(children))]
+	}
+	x := rand.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return children[i]
+		}
+		x -= w
+	}
+	return children[len(children)-1]
+}
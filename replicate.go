@@ -0,0 +1,410 @@
+package dilithium
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quorum is the number of children of a ReplicateShard that must acknowledge
+// a write, configured with the 'w' key: "one", "majority", "all" or a number.
+type quorum struct {
+	name string // "one", "majority" or "all", empty for a fixed number
+	n    int
+}
+
+func parseQuorum(config map[string]interface{}) (quorum, error) {
+	v, ok := config["w"]
+	if !ok {
+		return quorum{name: "all"}, nil
+	}
+	switch v := v.(type) {
+	case string:
+		switch v {
+		case "one", "majority", "all":
+			return quorum{name: v}, nil
+		}
+	case float64:
+		if v >= 1 && v == math.Trunc(v) {
+			return quorum{n: int(v)}, nil
+		}
+	case int:
+		if v >= 1 {
+			return quorum{n: v}, nil
+		}
+	}
+	return quorum{}, fmt.Errorf("dilithium: Invalid ReplicateShard config 'w', expecting one, majority, all or a positive integer, got %v", v)
+}
+
+// required returns the number of acknowledgements needed out of n children.
+func (w quorum) required(n int) int {
+	switch w.name {
+	case "one":
+		return 1
+	case "majority":
+		return n/2 + 1
+	case "all":
+		return n
+	}
+	return w.n
+}
+
+// ChildError is the error returned by a child shard.
+type ChildError struct {
+	ID  string
+	Err error
+}
+
+// QuorumError is returned by ReplicateShard when fewer children than the write
+// quorum acknowledged a write.
+type QuorumError struct {
+	Required int
+	Acked    int
+	Errors   []ChildError
+}
+
+func (e *QuorumError) Error() string {
+	return fmt.Sprintf("dilithium: write quorum not met, %d of %d required children acked: %s", e.Acked, e.Required, joinChildErrors(e.Errors))
+}
+
+// ReadError is returned by ReplicateShard when a read failed on every child
+// it was attempted on.
+type ReadError struct {
+	Errors []ChildError
+}
+
+func (e *ReadError) Error() string {
+	return fmt.Sprintf("dilithium: read failed on %d children: %s", len(e.Errors), joinChildErrors(e.Errors))
+}
+
+func joinChildErrors(errs []ChildError) string {
+	s := make([]string, len(errs))
+	for i, ce := range errs {
+		s[i] = fmt.Sprintf("'%s': %s", ce.ID, ce.Err)
+	}
+	return strings.Join(s, "; ")
+}
+
+// ReplicaStats contains the statistics a ReplicateShard keeps for a child.
+type ReplicaStats struct {
+	Reads       int64
+	ReadErrors  int64
+	Writes      int64
+	WriteErrors int64
+	// Outstanding is the number of reads in flight.
+	Outstanding int64
+	// Latency is the exponentially weighted moving average of the latency of
+	// successful reads.
+	Latency time.Duration
+	// LastError is the last error returned by the child.
+	LastError string
+	// DownUntil is the time until which the child is considered down after
+	// returning an error.
+	DownUntil time.Time
+	// Hedges is the number of reads sent to the child because another child
+	// was slow to answer.
+	Hedges int64
+	// Hints is the number of writes queued for the child by hinted handoff.
+	Hints int64
+}
+
+// latencyDecay is the weight of a new sample in ReplicaStats.Latency.
+const latencyDecay = 0.2
+
+// decayLatency returns the moving average avg updated with a new sample.
+func decayLatency(avg, latency time.Duration) time.Duration {
+	if avg == 0 {
+		return latency
+	}
+	return avg + time.Duration(latencyDecay*float64(latency-avg))
+}
+
+// replicaStats holds the per-child statistics of a ReplicateShard, keyed by
+// child ID. It is updated by writes that finish after the query returned, so
+// it has its own lock.
+type replicaStats struct {
+	mu         sync.Mutex
+	stats      map[string]*ReplicaStats
+	downPeriod time.Duration
+	latencies  latencies
+}
+
+// defaultDownPeriod is the time a child is considered down after an error,
+// unless 'down_period' is configured.
+const defaultDownPeriod = 5 * time.Second
+
+func (s *replicaStats) setDownPeriod(d time.Duration) {
+	s.mu.Lock()
+	s.downPeriod = d
+	s.mu.Unlock()
+}
+
+// markDown updates when cs is considered down after a query returned err. The
+// caller must hold s.mu.
+func (s *replicaStats) markDown(cs *ReplicaStats, err error) {
+	if err != nil {
+		cs.LastError = err.Error()
+		cs.DownUntil = nowFunc().Add(s.downPeriod)
+	} else {
+		cs.DownUntil = time.Time{}
+	}
+}
+
+// down reports whether the child with the given ID is considered down.
+func (s *replicaStats) down(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return nowFunc().Before(s.child(id).DownUntil)
+}
+
+// child returns the statistics of child id. The caller must hold s.mu.
+func (s *replicaStats) child(id string) *ReplicaStats {
+	if s.stats == nil {
+		s.stats = make(map[string]*ReplicaStats)
+	}
+	cs, ok := s.stats[id]
+	if !ok {
+		cs = &ReplicaStats{}
+		s.stats[id] = cs
+	}
+	return cs
+}
+
+func (s *replicaStats) recordWrite(id string, err error) {
+	s.mu.Lock()
+	cs := s.child(id)
+	cs.Writes++
+	if err != nil {
+		cs.WriteErrors++
+	}
+	s.markDown(cs, err)
+	s.mu.Unlock()
+}
+
+func (s *replicaStats) startRead(id string, hedge bool) {
+	s.mu.Lock()
+	cs := s.child(id)
+	cs.Outstanding++
+	if hedge {
+		cs.Hedges++
+	}
+	s.mu.Unlock()
+}
+
+// abandonRead records a read that was cancelled because another child
+// answered first or the caller gave up.
+func (s *replicaStats) abandonRead(id string) {
+	s.mu.Lock()
+	s.child(id).Outstanding--
+	s.mu.Unlock()
+}
+
+func (s *replicaStats) finishRead(id string, latency time.Duration, err error) {
+	s.mu.Lock()
+	cs := s.child(id)
+	cs.Outstanding--
+	cs.Reads++
+	s.markDown(cs, err)
+	if err != nil {
+		cs.ReadErrors++
+		s.mu.Unlock()
+		return
+	}
+	s.latencies.add(latency)
+	cs.Latency = decayLatency(cs.Latency, latency)
+	s.mu.Unlock()
+}
+
+func (s *replicaStats) snapshot() map[string]ReplicaStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make(map[string]ReplicaStats, len(s.stats))
+	for id, cs := range s.stats {
+		stats[id] = *cs
+	}
+	return stats
+}
+
+// Stats returns the statistics of the shard's children, keyed by child ID.
+func (r *ReplicateShard) Stats() map[string]ReplicaStats {
+	stats := r.stats.snapshot()
+	r.RLock()
+	for s, h := range r.hints {
+		cs := stats[s.ID()]
+		cs.Hints = h.depth()
+		stats[s.ID()] = cs
+	}
+	r.RUnlock()
+	return stats
+}
+
+var errNoChildren = errors.New("dilithium: ReplicateShard has no children")
+
+// read runs a read query on the child picked by the shard's read strategy,
+// failing over to other children on error and hedging slow reads. The caller
+// must hold r's read lock.
+func (r *ReplicateShard) read(ctx context.Context, q *Query) error {
+	if len(r.children) == 0 {
+		return errNoChildren
+	}
+	attempts := r.readAttempts
+	if attempts == 0 || attempts > len(r.children) {
+		attempts = len(r.children)
+	}
+
+	// the losers of a hedged read are cancelled when read returns
+	readCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan readResult, attempts)
+	tried := make(map[Shard]bool, attempts)
+	inflight := 0
+	start := func(hedge bool) {
+		s := r.strategy.pick(r.candidates(tried), &r.stats)
+		tried[s] = true
+		inflight++
+		go r.readChild(readCtx, s, q.clone(), hedge, results)
+	}
+	start(false)
+
+	var hedge <-chan time.Time
+	if d := r.hedge.after(&r.stats); d > 0 && attempts > 1 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+
+	var errs []ChildError
+	for inflight > 0 {
+		select {
+		case <-hedge:
+			hedge = nil
+			if len(tried) < attempts {
+				start(true)
+			}
+		case res := <-results:
+			inflight--
+			if res.err == nil {
+				q.Reply = res.q.Reply
+				q.ServedBy = res.q.ServedBy
+				return nil
+			}
+			errs = append(errs, ChildError{res.id, res.err})
+			if len(tried) < attempts && ctx.Err() == nil {
+				start(false)
+			}
+		}
+	}
+	if len(errs) == 1 {
+		return errs[0].Err
+	}
+	return &ReadError{errs}
+}
+
+type readResult struct {
+	id  string
+	q   *Query
+	err error
+}
+
+// candidates returns the children that have not been tried yet, leaving out
+// those that are down unless no other child is left. The caller must hold
+// r's read lock.
+func (r *ReplicateShard) candidates(tried map[Shard]bool) []Shard {
+	var up, down []Shard
+	for _, s := range r.children {
+		switch {
+		case tried[s]:
+		case r.stats.down(s.ID()):
+			down = append(down, s)
+		default:
+			up = append(up, s)
+		}
+	}
+	if len(up) == 0 {
+		return down
+	}
+	return up
+}
+
+// readChild runs a read query on child s, records the outcome and sends it
+// to results. A read cancelled because another child answered first, or
+// because the caller gave up, is not counted against the child.
+func (r *ReplicateShard) readChild(ctx context.Context, s Shard, q *Query, hedge bool, results chan<- readResult) {
+	id := s.ID()
+	r.stats.startRead(id, hedge)
+	start := time.Now()
+	err := s.Query(ctx, q)
+	if err != nil && ctx.Err() != nil {
+		r.stats.abandonRead(id)
+	} else {
+		r.stats.finishRead(id, time.Since(start), err)
+	}
+	results <- readResult{id, q, err}
+}
+
+// write runs a write query on every child concurrently and returns as soon as
+// the write quorum succeeded, or a QuorumError once it can no longer be met.
+// Writes still running when write returns are not canceled, but are bounded
+// by the configured 'child_timeout', and their outcome is recorded in the
+// shard's stats. The caller must hold r's read lock.
+func (r *ReplicateShard) write(ctx context.Context, q *Query) error {
+	children := r.children
+	timeout := r.childTimeout
+	required := r.w.required(len(children))
+	if len(children) == 0 {
+		return errNoChildren
+	}
+	if required > len(children) {
+		// checked before writing, as the write could never be acknowledged
+		return fmt.Errorf("dilithium: ReplicateShard write quorum of %d exceeds its %d children", required, len(children))
+	}
+
+	results := make(chan ChildError, len(children))
+	for _, s := range children {
+		h := r.hints[s]
+		var turn hintTurn
+		if h != nil {
+			turn = h.reserve()
+		}
+		go func(s Shard) {
+			cctx := context.WithoutCancel(ctx)
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				cctx, cancel = context.WithTimeout(cctx, timeout)
+				defer cancel()
+			}
+			id := s.ID()
+			var err error
+			if h != nil {
+				err = h.write(cctx, q, turn)
+			} else {
+				err = s.Query(cctx, q)
+			}
+			r.stats.recordWrite(id, err)
+			results <- ChildError{id, err}
+		}(s)
+	}
+
+	var acked int
+	var errs []ChildError
+	for pending := len(children); acked < required && acked+pending >= required; pending-- {
+		select {
+		case res := <-results:
+			if res.Err != nil {
+				errs = append(errs, res)
+			} else {
+				acked++
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if acked >= required {
+		return nil
+	}
+	return &QuorumError{Required: required, Acked: acked, Errors: errs}
+}
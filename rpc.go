@@ -5,10 +5,13 @@
 package dilithium
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/rpc"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"unicode"
@@ -16,10 +19,12 @@ import (
 )
 
 type methodType struct {
-	method    reflect.Method
-	ArgType   reflect.Type
-	ReplyType reflect.Type
-	readOnly  bool // if false, ReplyType is nil
+	method       reflect.Method
+	ConnType     reflect.Type
+	ArgType      reflect.Type
+	ReplyType    reflect.Type
+	readOnly     bool // if false, ReplyType is nil
+	takesContext bool // if true, the first argument is a context.Context
 }
 
 type service struct {
@@ -43,6 +48,7 @@ type rpcServer Server
 // because Typeof takes an empty interface value.  This is annoying.
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
 var typeOfQueryArg = reflect.TypeOf((*QueryArg)(nil)).Elem()
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
 
 var DefaultServer = NewServer(nil)
 
@@ -95,15 +101,21 @@ func (s *Server) Register(rcvr interface{}) error {
 		if method.PkgPath != "" {
 			continue
 		}
-		// Method needs three or four ins.
+		// Method may take a context.Context before the connection.
+		in := 1
+		takesContext := mtype.NumIn() > 1 && mtype.In(1) == typeOfContext
+		if takesContext {
+			in++
+		}
+		// Method needs three or four ins, not counting the context.
 		// ReadOnly: receiver, *conn, *arg, *reply
 		// Write: receiver, *conn, *arg
-		if mtype.NumIn() != 3 && mtype.NumIn() != 4 {
+		if n := mtype.NumIn() - in + 1; n != 3 && n != 4 {
 			log.Println("method", mname, "has wrong number of ins:", mtype.NumIn())
 			continue
 		}
 		// First arg must be a pointer.
-		connType := mtype.In(1)
+		connType := mtype.In(in)
 		if connType.Kind() != reflect.Ptr {
 			log.Println("method", mname, "connection type not a pointer:", connType)
 			continue
@@ -114,7 +126,7 @@ func (s *Server) Register(rcvr interface{}) error {
 			continue
 		}
 		// Second arg need not be a pointer, but must be exported and implement QueryArg.
-		argType := mtype.In(2)
+		argType := mtype.In(in + 1)
 		if !isExportedOrBuiltinType(argType) {
 			log.Println(mname, "argument type not exported:", argType)
 			continue
@@ -125,10 +137,10 @@ func (s *Server) Register(rcvr interface{}) error {
 		}
 		var replyType reflect.Type
 		var readOnly bool
-		if mtype.NumIn() == 4 {
+		if mtype.NumIn() == in+3 {
 			readOnly = true
 			// Third arg must be a pointer.
-			replyType = mtype.In(3)
+			replyType = mtype.In(in + 2)
 			if replyType.Kind() != reflect.Ptr {
 				log.Println("method", mname, "reply type not a pointer:", replyType)
 				continue
@@ -149,7 +161,10 @@ func (s *Server) Register(rcvr interface{}) error {
 			log.Println("method", mname, "returns", returnType.String(), "not error")
 			continue
 		}
-		service.methods[mname] = &methodType{method: method, ArgType: argType, ReplyType: replyType.Elem(), readOnly: readOnly}
+		if replyType != nil {
+			replyType = replyType.Elem()
+		}
+		service.methods[mname] = &methodType{method: method, ConnType: connType, ArgType: argType, ReplyType: replyType, readOnly: readOnly, takesContext: takesContext}
 	}
 
 	if len(service.methods) == 0 {
@@ -157,16 +172,154 @@ func (s *Server) Register(rcvr interface{}) error {
 		log.Fatal(e)
 		return errors.New(e)
 	}
+	if err := s.checkConnTypes(service); err != nil {
+		return err
+	}
 	s.services[service.name] = service
 	return nil
 }
 
+// Validate checks the connection type of every registered service method
+// against the pool types of the PhysicalShards in the forwarding table, and
+// returns a ConnTypeError listing the incompatible pairs. Register performs
+// the same check for the service being registered, so Validate only needs to
+// be called after shards are added to the table.
+func (s *Server) Validate() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	services := make([]*service, 0, len(s.services))
+	for _, svc := range s.services {
+		services = append(services, svc)
+	}
+	return s.checkConnTypes(services...)
+}
+
+// ConnTypeMismatch describes a service method that takes a connection type the
+// pool of a PhysicalShard does not dial.
+type ConnTypeMismatch struct {
+	Method   string // "Service.Method"
+	ShardID  string
+	PoolType string
+	// MethodConnType is the connection type taken by the method and
+	// PoolConnType the type dialed by the shard's pool.
+	MethodConnType reflect.Type
+	PoolConnType   reflect.Type
+}
+
+// ConnTypeError is returned by Register and Validate when service methods
+// could be routed to PhysicalShards that dial incompatible connections.
+type ConnTypeError []ConnTypeMismatch
+
+func (e ConnTypeError) Error() string {
+	lines := make([]string, len(e))
+	for i, m := range e {
+		lines[i] = fmt.Sprintf("%s takes %s, shard '%s' pool '%s' dials %s", m.Method, m.MethodConnType, m.ShardID, m.PoolType, m.PoolConnType)
+	}
+	return "dilithium: incompatible connection types: " + strings.Join(lines, "; ")
+}
+
+// checkConnTypes checks the connection types of the methods of services
+// against the typed pools of the PhysicalShards in the forwarding table.
+func (s *Server) checkConnTypes(services ...*service) error {
+	var shards []*PhysicalShard
+	seen := make(map[*PhysicalShard]bool)
+	for _, e := range s.forwarding.Entries() {
+		walkShards(e.Shard, func(s Shard) {
+			if p, ok := s.(*PhysicalShard); ok && !seen[p] && p.connType() != nil {
+				seen[p] = true
+				shards = append(shards, p)
+			}
+		})
+	}
+	if len(shards) == 0 {
+		return nil
+	}
+
+	var mismatches ConnTypeError
+	for _, svc := range services {
+		for mname, m := range svc.methods {
+			for _, p := range shards {
+				if t := p.connType(); !t.AssignableTo(m.ConnType) {
+					mismatches = append(mismatches, ConnTypeMismatch{
+						Method:         svc.name + "." + mname,
+						ShardID:        p.ID(),
+						PoolType:       p.poolType(),
+						MethodConnType: m.ConnType,
+						PoolConnType:   t,
+					})
+				}
+			}
+		}
+	}
+	if len(mismatches) == 0 {
+		return nil
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		if mismatches[i].Method != mismatches[j].Method {
+			return mismatches[i].Method < mismatches[j].Method
+		}
+		return mismatches[i].ShardID < mismatches[j].ShardID
+	})
+	return mismatches
+}
+
 func (s *Server) RegisterWithRPC(r *rpc.Server) {
 	server := rpcServer(*s)
 	r.RegisterName("dilithium", &server)
 }
 
+// Query resolves the query's service method and routes it through the
+// forwarding table. The caller can read the result from q.Reply.
+func (s *Server) Query(ctx context.Context, q *Query) error {
+	return (*rpcServer)(s).query(ctx, q)
+}
+
 func (s *rpcServer) Query(q *Query, reply *interface{}) error {
+	if err := s.rpcQuery(q); err != nil {
+		return err
+	}
+	*reply = q.Reply
+	return nil
+}
+
+// QueryReply is the reply of the QueryWithServedBy RPC method.
+type QueryReply struct {
+	Reply interface{}
+	// ServedBy is the ID of the PhysicalShard that answered a read-only
+	// query, as in Query.ServedBy.
+	ServedBy string
+}
+
+// QueryWithServedBy is the Query RPC method, also replying with the shard
+// that served the query.
+func (s *rpcServer) QueryWithServedBy(q *Query, reply *QueryReply) error {
+	if err := s.rpcQuery(q); err != nil {
+		return err
+	}
+	*reply = QueryReply{q.Reply, q.ServedBy}
+	return nil
+}
+
+// rpcQuery runs a query received over RPC, bounded by its Timeout.
+func (s *rpcServer) rpcQuery(q *Query) error {
+	ctx := context.Background()
+	if q.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.Timeout)
+		defer cancel()
+	}
+	return s.query(ctx, q)
+}
+
+func (s *rpcServer) query(ctx context.Context, q *Query) error {
+	if err := s.resolve(q); err != nil {
+		return err
+	}
+	return q.Route(ctx)
+}
+
+// resolve looks up the query's service method.
+func (s *rpcServer) resolve(q *Query) error {
 	q.server = s
 	serviceMethod := strings.Split(q.Method, ".")
 	if len(serviceMethod) != 2 {
@@ -182,11 +335,5 @@ func (s *rpcServer) Query(q *Query, reply *interface{}) error {
 	if q.method == nil {
 		return errors.New("dilithium: can't find method " + q.Method)
 	}
-
-	err := q.Route()
-	if err != nil {
-		return err
-	}
-	*reply = q.Reply
 	return nil
 }
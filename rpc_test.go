@@ -1,11 +1,13 @@
 package dilithium_test
 
 import (
+	"context"
 	"encoding/gob"
 	"net"
 	"net/rpc"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/cupcake/dilithium"
 	. "launchpad.net/gocheck"
@@ -73,8 +75,14 @@ func (s *ExampleService) GetURL(conn *ExampleDatastore, k IntShardKey, url *stri
 	return nil
 }
 
+func (s *ExampleService) WaitForCancel(ctx context.Context, conn *ExampleDatastore, k IntShardKey, res *string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
 var client *rpc.Client
 var forwardingTable *dilithium.ForwardingTable
+var dserver *dilithium.Server
 
 func startServer() {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
@@ -88,10 +96,15 @@ func startServer() {
 	shard.Setup(map[string]interface{}{"url": "shard1", "pool": "example"})
 	forwardingTable.Insert(&dilithium.ForwardingTableEntry{100, shard})
 
-	dserver := dilithium.NewServer(forwardingTable)
+	dserver = dilithium.NewServer(forwardingTable)
 	dserver.Register(&ExampleService{})
 	dserver.RegisterWithRPC(rpcServer)
 
+	// inserted after registration to test the checks at query time
+	typedShard := &dilithium.PhysicalShard{}
+	typedShard.Setup(map[string]interface{}{"url": "typed1", "pool": "typedtest"})
+	forwardingTable.Insert(&dilithium.ForwardingTableEntry{200, typedShard})
+
 	go rpcServer.Accept(l)
 	client, err = rpc.Dial("tcp", l.Addr().String())
 	if err != nil {
@@ -110,6 +123,40 @@ func (s *RPCSuite) TestStuff(c *C) {
 	c.Assert(*res, Equals, "shard1")
 }
 
+func (s *RPCSuite) TestServedBy(c *C) {
+	res := new(dilithium.QueryReply)
+	err := client.Call("dilithium.QueryWithServedBy", &dilithium.Query{Method: "ExampleService.GetURL", Arg: IntShardKey(1)}, res)
+	MaybeFail(c, err)
+	c.Assert(res.Reply, Equals, "shard1")
+	c.Assert(res.ServedBy, Equals, "shard1")
+}
+
+func (s *RPCSuite) TestTimeout(c *C) {
+	res := new(interface{})
+	q := &dilithium.Query{Method: "ExampleService.WaitForCancel", Arg: IntShardKey(1), Timeout: 10 * time.Millisecond}
+	err := client.Call("dilithium.Query", q, res)
+	c.Assert(err, ErrorMatches, context.DeadlineExceeded.Error())
+}
+
+func (s *RPCSuite) TestConnTypeMismatch(c *C) {
+	res := new(interface{})
+	err := client.Call("dilithium.Query", &dilithium.Query{Method: "ExampleService.GetURL", Arg: IntShardKey(150)}, res)
+	c.Assert(err, ErrorMatches, "dilithium: ExampleService.GetURL expects connection of type \\*dilithium_test.ExampleDatastore, got \\*dilithium_test.testConn")
+}
+
+func (s *RPCSuite) TestValidateConnTypes(c *C) {
+	err := dserver.Validate()
+	c.Assert(err, FitsTypeOf, dilithium.ConnTypeError{})
+	mismatches := err.(dilithium.ConnTypeError)
+	c.Assert(mismatches, HasLen, 2)
+	c.Assert(mismatches[0].Method, Equals, "ExampleService.GetURL")
+	c.Assert(mismatches[0].ShardID, Equals, "typed1")
+	c.Assert(mismatches[0].PoolType, Equals, "typedtest")
+
+	server := dilithium.NewServer(forwardingTable)
+	c.Assert(server.Register(&ExampleService{}), ErrorMatches, "dilithium: incompatible connection types: ExampleService.GetURL takes .*")
+}
+
 func MaybeFail(c *C, err error) {
 	if err != nil {
 		c.Log(err)
@@ -125,5 +172,18 @@ func init() {
 			return c, nil
 		},
 	})
+	dilithium.RegisterTypedPoolType("typedtest", dilithium.NewTypedPool(func(url string) (*testConn, error) {
+		return &testConn{}, nil
+	}, 1))
 	gob.Register(IntShardKey(0))
 }
+
+func (s *RPCSuite) TestPoolStats(c *C) {
+	res := new(interface{})
+	err := client.Call("dilithium.Query", &dilithium.Query{Method: "ExampleService.GetURL", Arg: IntShardKey(1)}, res)
+	MaybeFail(c, err)
+
+	stats := forwardingTable.PoolStats()
+	c.Assert(stats, HasLen, 2)
+	c.Assert(stats["shard1"].Dials > 0, Equals, true)
+}
@@ -1,11 +1,15 @@
 package dilithium
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"math/rand"
+	"log"
+	"reflect"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/titanous/guid"
 )
@@ -19,7 +23,9 @@ type Shard interface {
 	// RemoveChild removes the child shard with ID() == id.
 	// The receiver is responsible for calling Destroy() on the child shard.
 	RemoveChild(id string)
-	Query(q *Query) error
+	// Query routes the query to a physical shard and runs it. The shard must
+	// stop waiting on children and connections when ctx is done.
+	Query(ctx context.Context, q *Query) error
 	// ID returns the shard ID. It must uniquely identify the shard.
 	ID() string
 	// Setup is called to setup the shard with the specified config.
@@ -32,10 +38,48 @@ type Shard interface {
 	sync.Locker
 }
 
+// ReplicateShard replicates writes to all of its children concurrently and
+// reads from one of them, picked by the configured 'strategy'. A write
+// succeeds if the write quorum configured with 'w' (one, majority, all or a
+// number, defaulting to all) succeeds. Each child write is bounded by the
+// optional 'child_timeout'.
+//
+// A failed read is retried on other children, up to 'read_attempts' children
+// in total (all children by default). A child that returns an error is
+// considered down for 'down_period' (5s by default) and is only read from
+// when no other child is left.
+//
+// If 'hedge_delay' is set, a read that has not been answered within the delay
+// is also sent to another child and the first reply wins. It is either a
+// duration or "p95" to use the shard's recent 95th percentile read latency.
+//
+// If 'hint_path' is set to a directory, writes a child fails to apply are
+// persisted there in a queue per child, named after its node name, so Setup
+// rejects a directory used by another ReplicateShard. Hints are replayed in
+// order every 'hint_retry' (1s by default) until they succeed or fail
+// 'hint_max_attempts' times. Writes are queued behind a child's pending hints
+// and replays may repeat writes that timed out, so writes must be idempotent.
+// Hints left by a previous run are replayed first, once the shard has
+// received a query.
+//
+// Config refers to children by node name, listed in child order by 'nodes'.
+// Unnamed children are named after their URL if they are PhysicalShards, and
+// after the lowest unused integer otherwise.
 type ReplicateShard struct {
-	parent   Shard
-	children []Shard
-	id       string
+	parent       Shard
+	children     []Shard
+	id           string
+	config       map[string]interface{}
+	names        nodeNames
+	w            quorum
+	strategy     readStrategy
+	readAttempts int
+	hedge        hedgePolicy
+	childTimeout time.Duration
+	stats        replicaStats
+	hintConfig   hintConfig
+	hints        map[Shard]*hintQueue
+	server       atomic.Pointer[rpcServer]
 	sync.RWMutex
 }
 
@@ -61,23 +105,40 @@ func (r *ReplicateShard) SetParent(s Shard) {
 
 func (r *ReplicateShard) AddChild(s Shard) {
 	r.Lock()
+	name := r.names.add(s, len(r.children))
 	r.children = append(r.children, s)
+	r.config = withConfig(r.config, "nodes", r.names.list(r.children))
+	if r.hintConfig.path != "" {
+		if r.hints == nil {
+			r.hints = make(map[Shard]*hintQueue)
+		}
+		r.hints[s] = newHintQueue(r, s, name)
+	}
 	r.Unlock()
 }
 
 func (r *ReplicateShard) RemoveChild(id string) {
+	var removed Shard
+	var h *hintQueue
 	r.Lock()
 	for i, s := range r.children {
 		if s.ID() == id {
-			s.Destroy()
+			removed, h = s, r.hints[s]
+			delete(r.hints, s)
 			// remove the element by setting it to the last element and truncating
 			r.children[i] = r.children[len(r.children)-1]
 			r.children[len(r.children)-1] = nil
 			r.children = r.children[:len(r.children)-1]
+			r.names.remove(s)
+			r.config = withConfig(r.config, "nodes", r.names.list(r.children))
 			break
 		}
 	}
 	r.Unlock()
+	if h != nil {
+		h.close()
+	}
+	destroyChild(removed)
 }
 
 func (r *ReplicateShard) ID() string {
@@ -88,42 +149,107 @@ func (r *ReplicateShard) ID() string {
 }
 
 func (r *ReplicateShard) Setup(config map[string]interface{}) error {
+	w, err := parseQuorum(config)
+	if err != nil {
+		return err
+	}
+	names, err := parseNodeNames(config, "ReplicateShard")
+	if err != nil {
+		return err
+	}
+	strategy, err := parseReadStrategy(config, &r.names)
+	if err != nil {
+		return err
+	}
+	childTimeout, _, err := configDuration(config, "child_timeout")
+	if err != nil {
+		return fmt.Errorf("dilithium: Invalid ReplicateShard config 'child_timeout': %s", err)
+	}
+	readAttempts, _, err := configInt(config, "read_attempts")
+	if err != nil {
+		return fmt.Errorf("dilithium: Invalid ReplicateShard config 'read_attempts': %s", err)
+	}
+	hedge, err := parseHedgePolicy(config)
+	if err != nil {
+		return err
+	}
+	hints, err := parseHintConfig(config)
+	if err != nil {
+		return err
+	}
+	downPeriod, ok, err := configDuration(config, "down_period")
+	if err != nil {
+		return fmt.Errorf("dilithium: Invalid ReplicateShard config 'down_period': %s", err)
+	}
+	if !ok {
+		downPeriod = defaultDownPeriod
+	}
+	if hints.path != "" && !claimQueuePath(hints.path) {
+		return fmt.Errorf("dilithium: Invalid ReplicateShard config 'hint_path', %s is used by another shard", hints.path)
+	}
 	r.Lock()
 	id, _ := guid.NextId()
 	r.id = strconv.FormatInt(id, 10)
+	r.config = config
+	r.names = names
+	r.w = w
+	r.strategy = strategy
+	r.readAttempts = readAttempts
+	r.hedge = hedge
+	r.hintConfig = hints
+	r.childTimeout = childTimeout
+	r.stats.setDownPeriod(downPeriod)
 	r.Unlock()
 	return nil
 }
 
 func (r *ReplicateShard) Config() map[string]interface{} {
-	return nil
+	r.RLock()
+	defer r.RUnlock()
+	return r.config
 }
 
 func (r *ReplicateShard) Destroy() {
 	r.Lock()
+	for _, h := range r.hints {
+		h.close()
+	}
+	if r.hintConfig.path != "" {
+		releaseQueuePath(r.hintConfig.path)
+	}
 	for _, s := range r.children {
 		s.Destroy()
 	}
 }
 
-func (r *ReplicateShard) Query(q *Query) (err error) {
+func (r *ReplicateShard) Query(ctx context.Context, q *Query) (err error) {
+	if q.server != nil {
+		r.server.Store(q.server)
+	}
 	r.RLock()
 	if q.ReadOnly() {
-		err = r.children[rand.Intn(len(r.children))].Query(q)
+		err = r.read(ctx, q)
 	} else {
-		for _, s := range r.children {
-			s.Query(q)
-		}
+		err = r.write(ctx, q)
 	}
 	r.RUnlock()
 	return
 }
 
+// poolWarmTimeout bounds the time PhysicalShard.Setup spends dialing the
+// pool's MinIdle connections.
+const poolWarmTimeout = 5 * time.Second
+
+// defaultDrainTimeout bounds the time PhysicalShard.Destroy waits for
+// connections in use to be returned, unless 'drain_timeout' is configured.
+const defaultDrainTimeout = 30 * time.Second
+
 type PhysicalShard struct {
 	parent Shard
 	sync.RWMutex
-	config map[string]interface{}
-	pool   *Pool
+	config       map[string]interface{}
+	pool         *Pool
+	drainTimeout time.Duration
 }
 
 func (p *PhysicalShard) Parent() Shard {
@@ -174,14 +300,77 @@ func (p *PhysicalShard) Setup(config map[string]interface{}) error {
 
 	}
 	poolTypesMtx.RLock()
-	defer poolTypesMtx.RUnlock()
 	poolType, ok := poolTypes[poolName]
+	poolTypesMtx.RUnlock()
 	if !ok {
 		return fmt.Errorf("dilithium: Unknown PhysicalShard pool type '%s'", poolName)
 	}
 
-	p.pool = &Pool{url: url, Dial: poolType.Dial, TestOnBorrow: poolType.TestOnBorrow, MaxIdle: poolType.MaxIdle, IdleTimeout: poolType.IdleTimeout}
+	pool := poolType.clone(url)
+	pool.config = config
+	if err := configurePool(pool, config); err != nil {
+		return fmt.Errorf("dilithium: Invalid PhysicalShard '%s' config %s", url, err)
+	}
+	drainTimeout, ok, err := configDuration(config, "drain_timeout")
+	if err != nil {
+		return fmt.Errorf("dilithium: Invalid PhysicalShard '%s' config 'drain_timeout': %s", url, err)
+	}
+	if !ok {
+		drainTimeout = defaultDrainTimeout
+	}
+
+	p.pool = pool
 	p.config = config
+	p.drainTimeout = drainTimeout
+
+	if p.pool.MinIdle > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), poolWarmTimeout)
+		defer cancel()
+		if err := p.pool.Warm(ctx); err != nil {
+			log.Printf("dilithium: PhysicalShard '%s' failed to warm pool: %s", url, err)
+		}
+	}
+	return nil
+}
+
+// configurePool overrides the settings of pool with the optional pool keys of
+// a PhysicalShard config.
+func configurePool(pool *Pool, config map[string]interface{}) error {
+	ints := []struct {
+		key   string
+		field *int
+	}{
+		{"max_idle", &pool.MaxIdle},
+		{"min_idle", &pool.MinIdle},
+		{"max_active", &pool.MaxActive},
+	}
+	for _, o := range ints {
+		n, ok, err := configInt(config, o.key)
+		if err != nil {
+			return fmt.Errorf("'%s': %s", o.key, err)
+		}
+		if ok {
+			*o.field = n
+		}
+	}
+
+	durations := []struct {
+		key   string
+		field *time.Duration
+	}{
+		{"idle_timeout", &pool.IdleTimeout},
+		{"max_lifetime", &pool.MaxConnLifetime},
+		{"dial_timeout", &pool.DialTimeout},
+	}
+	for _, o := range durations {
+		d, ok, err := configDuration(config, o.key)
+		if err != nil {
+			return fmt.Errorf("'%s': %s", o.key, err)
+		}
+		if ok {
+			*o.field = d
+		}
+	}
 	return nil
 }
 
@@ -191,9 +380,19 @@ func (p *PhysicalShard) Config() map[string]interface{} {
 	return p.config
 }
 
+// Destroy drains the shard's pool, waiting up to the configured drain timeout
+// for queries to return their connections.
 func (p *PhysicalShard) Destroy() {
+	p.RLock()
+	pool, url, timeout := p.pool, p.pool.url, p.drainTimeout
+	p.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if forced := pool.Drain(ctx); forced > 0 {
+		log.Printf("dilithium: PhysicalShard '%s' closed %d connections in use after %s", url, forced, timeout)
+	}
 	p.Lock()
-	p.pool.Close()
 }
 
 func (p *PhysicalShard) ID() string {
@@ -202,19 +401,75 @@ func (p *PhysicalShard) ID() string {
 	return p.pool.url
 }
 
-func (p *PhysicalShard) Query(q *Query) error {
+// connType returns the type of the connections dialed by the shard's pool, or
+// nil if the pool type is untyped.
+func (p *PhysicalShard) connType() reflect.Type {
 	p.RLock()
 	defer p.RUnlock()
-	// TODO: error handling
-	conn, err := p.pool.Get()
+	return p.pool.connType
+}
+
+// poolType returns the name of the shard's pool type.
+func (p *PhysicalShard) poolType() string {
+	p.RLock()
+	defer p.RUnlock()
+	name, _ := p.config["pool"].(string)
+	return name
+}
+
+// PoolStats returns a snapshot of the statistics of the shard's connection pool.
+func (p *PhysicalShard) PoolStats() PoolStats {
+	p.RLock()
+	defer p.RUnlock()
+	return p.pool.Stats()
+}
+
+func (p *PhysicalShard) Query(ctx context.Context, q *Query) error {
+	p.RLock()
+	defer p.RUnlock()
+	if t := p.pool.connType; t != nil {
+		if err := q.checkConnType(t); err != nil {
+			return err
+		}
+	}
+	conn, err := p.pool.GetContext(ctx)
 	defer conn.Close()
 	if err != nil {
 		return err
 	}
-	return q.Run(conn.c)
+	err = q.Run(ctx, conn.c)
+	conn.CheckErr(err)
+	if err == nil && q.ReadOnly() {
+		q.ServedBy = p.pool.url
+	}
+	return err
+}
+
+// destroyChild destroys a child detached by RemoveChild. It is called after
+// the parent's lock is released, as PhysicalShards wait for their connections
+// in use to be returned.
+func destroyChild(s Shard) {
+	if s != nil {
+		s.Destroy()
+	}
+}
+
+// walkShards calls fn for s and each of its descendants, depth first.
+func walkShards(s Shard, fn func(Shard)) {
+	fn(s)
+	for _, child := range s.Children() {
+		walkShards(child, fn)
+	}
 }
 
 func init() {
 	RegisterShardType(&ReplicateShard{})
 	RegisterShardType(&PhysicalShard{})
+	RegisterShardType(&PrimaryShard{})
+	RegisterShardType(&HashShard{})
+	RegisterShardType(&RangeShard{})
+	RegisterShardType(&MirrorShard{})
+	RegisterShardType(&CacheShard{})
+	RegisterShardType(&WriteBehindShard{})
+	RegisterShardType(&MigrateShard{})
 }
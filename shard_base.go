@@ -0,0 +1,130 @@
+package dilithium
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/titanous/guid"
+)
+
+// baseShard implements the tree bookkeeping shared by shards with children.
+// Shard types embed it and implement Query and Setup, calling setup from the
+// latter. Children keep the order in which they were added.
+//
+// Shard types whose config refers to children set names in Setup, so that the
+// children are named and their names kept in the 'nodes' config.
+type baseShard struct {
+	parent   Shard
+	children []Shard
+	id       string
+	config   map[string]interface{}
+	names    *nodeNames
+	sync.RWMutex
+}
+
+// setup assigns the shard a new ID and stores its config. The caller must
+// hold b's lock.
+func (b *baseShard) setup(config map[string]interface{}) {
+	id, _ := guid.NextId()
+	b.id = strconv.FormatInt(id, 10)
+	b.config = config
+}
+
+func (b *baseShard) Parent() Shard {
+	b.RLock()
+	p := b.parent
+	b.RUnlock()
+	return p
+}
+
+func (b *baseShard) Children() []Shard {
+	b.RLock()
+	c := b.children
+	b.RUnlock()
+	return c
+}
+
+func (b *baseShard) SetParent(s Shard) {
+	b.Lock()
+	b.parent = s
+	b.Unlock()
+}
+
+func (b *baseShard) AddChild(s Shard) {
+	b.Lock()
+	b.addChild(s)
+	b.Unlock()
+}
+
+// addChild appends s to the children. The caller must hold b's lock.
+func (b *baseShard) addChild(s Shard) {
+	if b.names != nil {
+		b.names.add(s, len(b.children))
+	}
+	b.children = append(b.children, s)
+	b.updateNames()
+}
+
+func (b *baseShard) RemoveChild(id string) {
+	b.Lock()
+	_, s := b.removeChild(id)
+	b.Unlock()
+	destroyChild(s)
+}
+
+// removeChild detaches the child with the given ID and returns its former
+// index, or nil if there is no such child. The caller must hold b's lock and
+// destroy the child with destroyChild after releasing it.
+func (b *baseShard) removeChild(id string) (int, Shard) {
+	for i, s := range b.children {
+		if s.ID() == id {
+			children := make([]Shard, 0, len(b.children)-1)
+			b.children = append(append(children, b.children[:i]...), b.children[i+1:]...)
+			if b.names != nil {
+				b.names.remove(s)
+			}
+			b.updateNames()
+			return i, s
+		}
+	}
+	return -1, nil
+}
+
+// updateNames records the names of the children in the 'nodes' config. The
+// caller must hold b's lock.
+func (b *baseShard) updateNames() {
+	if b.names != nil {
+		b.config = withConfig(b.config, "nodes", b.names.list(b.children))
+	}
+}
+
+// child returns the child with the given ID, or nil. The caller must hold b's
+// read lock.
+func (b *baseShard) child(id string) Shard {
+	for _, s := range b.children {
+		if s.ID() == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func (b *baseShard) ID() string {
+	b.RLock()
+	id := b.id
+	b.RUnlock()
+	return id
+}
+
+func (b *baseShard) Config() map[string]interface{} {
+	b.RLock()
+	defer b.RUnlock()
+	return b.config
+}
+
+func (b *baseShard) Destroy() {
+	b.Lock()
+	for _, s := range b.children {
+		s.Destroy()
+	}
+}
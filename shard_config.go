@@ -5,8 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
 	"strconv"
+	"time"
 )
 
 type ShardConfig struct {
@@ -17,7 +19,7 @@ type ShardConfig struct {
 
 func NewForwardingTableFromJSON(r io.Reader) (*ForwardingTable, error) {
 	config := make(map[string]ShardConfig)
-	err := json.NewDecoder(r).Decode(config)
+	err := json.NewDecoder(r).Decode(&config)
 	if err != nil {
 		return nil, err
 	}
@@ -29,7 +31,7 @@ func NewForwardingTable(config map[string]ShardConfig) (*ForwardingTable, error)
 	for m, c := range config {
 		maxKey, err := strconv.Atoi(m)
 		if err != nil {
-			return nil, fmt.Errorf("dilithium: Invalid maxKey from JSON config, expecting integer, got '%s'", maxKey)
+			return nil, fmt.Errorf("dilithium: Invalid maxKey from JSON config, expecting integer, got '%s'", m)
 		}
 
 		shard, err := c.NewShard()
@@ -86,3 +88,58 @@ func NewShardConfig(s Shard) (*ShardConfig, error) {
 
 	return config, nil
 }
+
+// configInt returns the non-negative integer value of key in a shard config.
+// JSON numbers are decoded as float64, so integral floats are accepted.
+func configInt(config map[string]interface{}, key string) (n int, ok bool, err error) {
+	v, ok := config[key]
+	if !ok {
+		return 0, false, nil
+	}
+	if n, err = toInt(v); err != nil {
+		return 0, true, err
+	}
+	if n < 0 {
+		return 0, true, fmt.Errorf("expecting non-negative integer, got %d", n)
+	}
+	return n, true, nil
+}
+
+// toInt returns the integer value of a config value, an int or an integral
+// float64.
+func toInt(v interface{}) (int, error) {
+	switch v := v.(type) {
+	case int:
+		return v, nil
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("expecting integer, got %v", v)
+		}
+		return int(v), nil
+	}
+	return 0, fmt.Errorf("expecting integer, got %T", v)
+}
+
+// configDuration returns the non-negative duration value of key in a shard
+// config, written as a string such as "300ms" or "1m30s".
+func configDuration(config map[string]interface{}, key string) (d time.Duration, ok bool, err error) {
+	v, ok := config[key]
+	if !ok {
+		return 0, false, nil
+	}
+	switch v := v.(type) {
+	case time.Duration:
+		d = v
+	case string:
+		d, err = time.ParseDuration(v)
+		if err != nil {
+			return 0, true, err
+		}
+	default:
+		return 0, true, fmt.Errorf("expecting duration string, got %T", v)
+	}
+	if d < 0 {
+		return 0, true, fmt.Errorf("expecting non-negative duration, got %s", d)
+	}
+	return d, true, nil
+}
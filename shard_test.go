@@ -0,0 +1,983 @@
+package dilithium_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cupcake/dilithium"
+	. "launchpad.net/gocheck"
+)
+
+type ShardSuite struct{}
+
+var _ = Suite(&ShardSuite{})
+
+func (s *ShardSuite) SetUpTest(c *C) {
+	backend.reset()
+}
+
+// testBackend records the queries run on BackendConns, keyed by URL, and
+// fails or delays them on demand.
+type testBackend struct {
+	sync.Mutex
+	errs   map[string]error
+	delays map[string]time.Duration
+	writes map[string][]int
+	reads  map[string]int
+	cache  map[string]string // CacheService entries
+}
+
+var backend = &testBackend{}
+
+func (b *testBackend) reset() {
+	b.Lock()
+	b.errs = make(map[string]error)
+	b.delays = make(map[string]time.Duration)
+	b.writes = make(map[string][]int)
+	b.reads = make(map[string]int)
+	b.cache = make(map[string]string)
+	b.Unlock()
+}
+
+func (b *testBackend) fail(url string, err error) {
+	b.Lock()
+	b.errs[url] = err
+	b.Unlock()
+}
+
+func (b *testBackend) delay(url string, d time.Duration) {
+	b.Lock()
+	b.delays[url] = d
+	b.Unlock()
+}
+
+func (b *testBackend) written(url string) []int {
+	b.Lock()
+	defer b.Unlock()
+	return append([]int(nil), b.writes[url]...)
+}
+
+func (b *testBackend) readCount(url string) int {
+	b.Lock()
+	defer b.Unlock()
+	return b.reads[url]
+}
+
+func (b *testBackend) do(ctx context.Context, url string, key int, write bool) error {
+	b.Lock()
+	err, d := b.errs[url], b.delays[url]
+	b.Unlock()
+	if d > 0 {
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	if write {
+		b.writes[url] = append(b.writes[url], key)
+	} else {
+		b.reads[url]++
+	}
+	b.Unlock()
+	return nil
+}
+
+type BackendConn struct {
+	url string
+}
+
+func (c *BackendConn) Close() {}
+
+type BackendKey int
+
+func (k BackendKey) ShardKey() int { return int(k) }
+
+type BackendService struct{}
+
+func (s *BackendService) Write(ctx context.Context, conn *BackendConn, k BackendKey) error {
+	return backend.do(ctx, conn.url, int(k), true)
+}
+
+func (s *BackendService) Read(ctx context.Context, conn *BackendConn, k BackendKey, url *string) error {
+	*url = conn.url
+	return backend.do(ctx, conn.url, int(k), false)
+}
+
+// CacheService is a cache for BackendService.Read, keyed by URL and key.
+type CacheService struct{}
+
+func cacheKey(conn *BackendConn, k BackendKey) string {
+	return conn.url + "/" + strconv.Itoa(int(k))
+}
+
+func (s *CacheService) Get(conn *BackendConn, k BackendKey, v *string) error {
+	backend.Lock()
+	defer backend.Unlock()
+	var ok bool
+	if *v, ok = backend.cache[cacheKey(conn, k)]; !ok {
+		return dilithium.ErrCacheMiss
+	}
+	return nil
+}
+
+func (s *CacheService) Set(conn *BackendConn, k BackendKey, v *string) error {
+	backend.Lock()
+	backend.cache[cacheKey(conn, k)] = *v
+	backend.Unlock()
+	return nil
+}
+
+// OtherKey is a shard key of another type than BackendKey.
+type OtherKey int
+
+func (k OtherKey) ShardKey() int { return int(k) }
+
+func (s *CacheService) GetOther(conn *BackendConn, k OtherKey, v *string) error {
+	return dilithium.ErrCacheMiss
+}
+
+func (s *CacheService) Delete(conn *BackendConn, k BackendKey) error {
+	backend.Lock()
+	if err := backend.errs[conn.url]; err != nil {
+		backend.Unlock()
+		return err
+	}
+	delete(backend.cache, cacheKey(conn, k))
+	backend.Unlock()
+	return nil
+}
+
+func physical(url string) dilithium.ShardConfig {
+	return dilithium.ShardConfig{Type: "physical", Config: map[string]interface{}{"url": url, "pool": "backend"}}
+}
+
+// newTestServer returns a server routing every key up to 100 to the shard
+// described by config.
+func newTestServer(c *C, config dilithium.ShardConfig) (*dilithium.Server, dilithium.Shard) {
+	table, err := dilithium.NewForwardingTable(map[string]dilithium.ShardConfig{"100": config})
+	c.Assert(err, IsNil)
+	server := dilithium.NewServer(table)
+	c.Assert(server.Register(&BackendService{}), IsNil)
+	return server, table.Lookup(0)
+}
+
+func write(server *dilithium.Server, key int) error {
+	return server.Query(context.Background(), &dilithium.Query{Method: "BackendService.Write", Arg: BackendKey(key)})
+}
+
+func read(server *dilithium.Server, key int) (string, error) {
+	q := &dilithium.Query{Method: "BackendService.Read", Arg: BackendKey(key)}
+	err := server.Query(context.Background(), q)
+	if err != nil {
+		return "", err
+	}
+	if url := *q.Reply.(*string); url != q.ServedBy {
+		return "", errors.New("read served by " + q.ServedBy + " returned " + url)
+	}
+	return q.ServedBy, nil
+}
+
+func (s *ShardSuite) TestPhysicalBrokenConn(c *C) {
+	server, shard := newTestServer(c, physical("a"))
+	defer shard.Destroy()
+
+	backend.fail("a", fmt.Errorf("connection reset: %w", dilithium.ErrBrokenConn))
+	c.Assert(write(server, 1), ErrorMatches, "connection reset: .*")
+	backend.fail("a", nil)
+	c.Assert(write(server, 2), IsNil)
+	c.Assert(shard.(*dilithium.PhysicalShard).PoolStats().BrokenClosed, Equals, int64(1))
+}
+
+func (s *ShardSuite) TestPhysicalPoolConfig(c *C) {
+	config := dilithium.ShardConfig{Type: "physical", Config: map[string]interface{}{
+		"url":          "test1",
+		"pool":         "test",
+		"max_idle":     float64(10),
+		"max_active":   float64(20),
+		"idle_timeout": "5m",
+		"max_lifetime": "1h",
+		"dial_timeout": "1s",
+	}}
+	shard, err := config.NewShard()
+	c.Assert(err, IsNil)
+	defer shard.Destroy()
+
+	exported, err := dilithium.NewShardConfig(shard)
+	c.Assert(err, IsNil)
+	data, err := json.Marshal(exported)
+	c.Assert(err, IsNil)
+	var decoded dilithium.ShardConfig
+	c.Assert(json.Unmarshal(data, &decoded), IsNil)
+	c.Assert(decoded.Config, DeepEquals, config.Config)
+
+	shard, err = decoded.NewShard()
+	c.Assert(err, IsNil)
+	shard.Destroy()
+}
+
+func (s *ShardSuite) TestPhysicalPoolConfigInvalid(c *C) {
+	config := dilithium.ShardConfig{Type: "physical", Config: map[string]interface{}{
+		"url":      "test1",
+		"pool":     "test",
+		"max_idle": "ten",
+	}}
+	_, err := config.NewShard()
+	c.Assert(err, ErrorMatches, "dilithium: Invalid PhysicalShard 'test1' config 'max_idle': expecting integer, got string")
+
+	config.Config["max_idle"] = float64(1)
+	config.Config["idle_timeout"] = "5 minutes"
+	_, err = config.NewShard()
+	c.Assert(err, ErrorMatches, "dilithium: Invalid PhysicalShard 'test1' config 'idle_timeout': .*")
+}
+
+func (s *ShardSuite) TestPhysicalDialConfig(c *C) {
+	var dialed map[string]interface{}
+	dilithium.RegisterPoolType("testconfig", &dilithium.Pool{
+		DialConfig: func(ctx context.Context, config map[string]interface{}) (dilithium.Closer, error) {
+			dialed = config
+			return &testConn{}, nil
+		},
+		MaxIdle: 1,
+		MinIdle: 1,
+	})
+	config := map[string]interface{}{"url": "test1", "pool": "testconfig", "db": float64(3)}
+	shard := &dilithium.PhysicalShard{}
+	c.Assert(shard.Setup(config), IsNil)
+	c.Assert(dialed, DeepEquals, config)
+	shard.Destroy()
+}
+
+func (s *ShardSuite) TestReplicateQuorum(c *C) {
+	config := dilithium.ShardConfig{Type: "replicate", Config: map[string]interface{}{"w": "majority"},
+		Children: []dilithium.ShardConfig{physical("a"), physical("b"), physical("c")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+
+	backend.fail("c", errors.New("c is down"))
+	c.Assert(write(server, 1), IsNil)
+	c.Assert(backend.written("a"), DeepEquals, []int{1})
+	c.Assert(backend.written("b"), DeepEquals, []int{1})
+
+	backend.fail("b", errors.New("b is down"))
+	err := write(server, 2)
+	c.Assert(err, FitsTypeOf, &dilithium.QuorumError{})
+	qerr := err.(*dilithium.QuorumError)
+	c.Assert(qerr.Required, Equals, 2)
+	c.Assert(qerr.Errors, HasLen, 2)
+	c.Assert(err, ErrorMatches, "dilithium: write quorum not met, [01] of 2 required children acked: .*'b': b is down.*")
+
+	exported, err := dilithium.NewShardConfig(shard)
+	c.Assert(err, IsNil)
+	c.Assert(exported.Config["w"], Equals, "majority")
+}
+
+func (s *ShardSuite) TestReplicateParallelWrites(c *C) {
+	config := dilithium.ShardConfig{Type: "replicate", Config: map[string]interface{}{"w": "majority", "child_timeout": "50ms"},
+		Children: []dilithium.ShardConfig{physical("a"), physical("b"), physical("c")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+
+	backend.delay("c", time.Second)
+	start := time.Now()
+	c.Assert(write(server, 1), IsNil)
+	c.Assert(time.Since(start) < 50*time.Millisecond, Equals, true)
+
+	// the straggler times out in the background and is recorded
+	time.Sleep(100 * time.Millisecond)
+	stats := shard.(*dilithium.ReplicateShard).Stats()
+	c.Assert(stats["a"].Writes, Equals, int64(1))
+	c.Assert(stats["c"].WriteErrors, Equals, int64(1))
+	c.Assert(stats["c"].LastError, Equals, context.DeadlineExceeded.Error())
+}
+
+func (s *ShardSuite) TestReplicateRemoveChildDrains(c *C) {
+	config := dilithium.ShardConfig{Type: "replicate", Config: map[string]interface{}{"w": "one"},
+		Children: []dilithium.ShardConfig{physical("a"), physical("b")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+
+	// b's write straggles in the background and holds a connection
+	backend.delay("b", 200*time.Millisecond)
+	c.Assert(write(server, 1), IsNil)
+	b := shard.Children()[1].(*dilithium.PhysicalShard)
+	waitFor(c, func() bool { return b.PoolStats().ActiveCount == 1 })
+	removed := make(chan bool)
+	go func() {
+		shard.RemoveChild("b")
+		close(removed)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// queries are not blocked while b drains
+	start := time.Now()
+	url, err := read(server, 1)
+	c.Assert(err, IsNil)
+	c.Assert(url, Equals, "a")
+	c.Assert(time.Since(start) < 100*time.Millisecond, Equals, true)
+	<-removed
+	c.Assert(backend.written("b"), DeepEquals, []int{1})
+}
+
+func (s *ShardSuite) TestReplicateRoundRobin(c *C) {
+	config := dilithium.ShardConfig{Type: "replicate", Config: map[string]interface{}{"strategy": "round_robin"},
+		Children: []dilithium.ShardConfig{physical("a"), physical("b")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+
+	for i := 0; i < 4; i++ {
+		_, err := read(server, 1)
+		c.Assert(err, IsNil)
+	}
+	stats := shard.(*dilithium.ReplicateShard).Stats()
+	c.Assert(stats["a"].Reads, Equals, int64(2))
+	c.Assert(stats["b"].Reads, Equals, int64(2))
+	c.Assert(stats["a"].Outstanding, Equals, int64(0))
+}
+
+func (s *ShardSuite) TestReplicateWeighted(c *C) {
+	config := dilithium.ShardConfig{Type: "replicate",
+		Config:   map[string]interface{}{"strategy": "weighted", "weights": map[string]interface{}{"a": float64(0)}},
+		Children: []dilithium.ShardConfig{physical("a"), physical("b")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+
+	for i := 0; i < 10; i++ {
+		url, err := read(server, 1)
+		c.Assert(err, IsNil)
+		c.Assert(url, Equals, "b")
+	}
+}
+
+func (s *ShardSuite) TestReplicateWeightedNodeNames(c *C) {
+	// children other than PhysicalShards are named after their index, and the
+	// names are exported so that the weights still apply after a reload
+	pair := func(a, b string) dilithium.ShardConfig {
+		return dilithium.ShardConfig{Type: "replicate", Children: []dilithium.ShardConfig{physical(a), physical(b)}}
+	}
+	config := dilithium.ShardConfig{Type: "replicate",
+		Config:   map[string]interface{}{"strategy": "weighted", "weights": map[string]interface{}{"0": float64(0)}},
+		Children: []dilithium.ShardConfig{pair("a", "b"), pair("c", "d")}}
+	for i := 0; i < 2; i++ {
+		server, shard := newTestServer(c, config)
+		for j := 0; j < 10; j++ {
+			url, err := read(server, 1)
+			c.Assert(err, IsNil)
+			c.Assert(url == "c" || url == "d", Equals, true)
+		}
+		exported, err := dilithium.NewShardConfig(shard)
+		c.Assert(err, IsNil)
+		c.Assert(exported.Config["nodes"], DeepEquals, []interface{}{"0", "1"})
+		shard.Destroy()
+		config = *exported
+	}
+
+	config.Config["nodes"] = []interface{}{"x", "x"}
+	_, err := config.NewShard()
+	c.Assert(err, ErrorMatches, "dilithium: Invalid ReplicateShard config 'nodes', duplicate name 'x'")
+}
+
+func (s *ShardSuite) TestReplicateLatency(c *C) {
+	config := dilithium.ShardConfig{Type: "replicate", Config: map[string]interface{}{"strategy": "latency"},
+		Children: []dilithium.ShardConfig{physical("a"), physical("b")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+
+	backend.delay("a", 10*time.Millisecond)
+	for i := 0; i < 20; i++ {
+		_, err := read(server, 1)
+		c.Assert(err, IsNil)
+	}
+	stats := shard.(*dilithium.ReplicateShard).Stats()
+	c.Assert(stats["a"].Latency > stats["b"].Latency, Equals, true)
+	c.Assert(stats["a"].Reads < 5, Equals, true)
+}
+
+func (s *ShardSuite) TestReplicateReadFailover(c *C) {
+	config := dilithium.ShardConfig{Type: "replicate", Config: map[string]interface{}{"strategy": "round_robin"},
+		Children: []dilithium.ShardConfig{physical("a"), physical("b"), physical("c")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+
+	backend.fail("a", errors.New("a is down"))
+	for i := 0; i < 3; i++ {
+		url, err := read(server, 1)
+		c.Assert(err, IsNil)
+		c.Assert(url, Not(Equals), "a")
+	}
+	// a is only tried once and then skipped while it is down
+	stats := shard.(*dilithium.ReplicateShard).Stats()
+	c.Assert(stats["a"].ReadErrors, Equals, int64(1))
+	c.Assert(stats["a"].DownUntil.IsZero(), Equals, false)
+
+	backend.fail("b", errors.New("b is down"))
+	backend.fail("c", errors.New("c is down"))
+	_, err := read(server, 1)
+	c.Assert(err, FitsTypeOf, &dilithium.ReadError{})
+	c.Assert(err.(*dilithium.ReadError).Errors, HasLen, 3)
+}
+
+func (s *ShardSuite) TestReplicateHedgedReads(c *C) {
+	config := dilithium.ShardConfig{Type: "replicate", Config: map[string]interface{}{"strategy": "round_robin", "hedge_delay": "10ms"},
+		Children: []dilithium.ShardConfig{physical("a"), physical("b")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+
+	backend.delay("a", time.Second)
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		url, err := read(server, 1)
+		c.Assert(err, IsNil)
+		c.Assert(url, Equals, "b")
+		c.Assert(time.Since(start) < 500*time.Millisecond, Equals, true)
+	}
+
+	// the slow read is cancelled without marking a as down
+	time.Sleep(10 * time.Millisecond)
+	stats := shard.(*dilithium.ReplicateShard).Stats()
+	c.Assert(stats["b"].Hedges, Equals, int64(2))
+	c.Assert(stats["a"].Outstanding, Equals, int64(0))
+	c.Assert(stats["a"].ReadErrors, Equals, int64(0))
+	c.Assert(stats["a"].DownUntil.IsZero(), Equals, true)
+}
+
+func (s *ShardSuite) TestReadCallerTimeout(c *C) {
+	// reads the caller gave up on do not mark the children down
+	for _, typ := range []string{"replicate", "primary"} {
+		config := dilithium.ShardConfig{Type: typ, Config: map[string]interface{}{"read_fallback": true},
+			Children: []dilithium.ShardConfig{physical("a"), physical("b")}}
+		server, shard := newTestServer(c, config)
+		backend.delay("a", 50*time.Millisecond)
+		backend.delay("b", 50*time.Millisecond)
+		for i := 0; i < 4; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+			q := &dilithium.Query{Method: "BackendService.Read", Arg: BackendKey(1)}
+			c.Assert(server.Query(ctx, q), NotNil)
+			cancel()
+		}
+		var stats map[string]dilithium.ReplicaStats
+		if typ == "replicate" {
+			stats = shard.(*dilithium.ReplicateShard).Stats()
+		} else {
+			stats = shard.(*dilithium.PrimaryShard).Stats()
+		}
+		for _, url := range []string{"a", "b"} {
+			c.Assert(stats[url].ReadErrors, Equals, int64(0))
+			c.Assert(stats[url].DownUntil.IsZero(), Equals, true)
+		}
+		backend.delay("a", 0)
+		backend.delay("b", 0)
+		shard.Destroy()
+	}
+}
+
+func (s *ShardSuite) TestReplicateHintedHandoff(c *C) {
+	config := dilithium.ShardConfig{Type: "replicate",
+		Config:   map[string]interface{}{"w": "one", "hint_path": c.MkDir(), "hint_retry": "10ms"},
+		Children: []dilithium.ShardConfig{physical("a"), physical("b")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+	r := shard.(*dilithium.ReplicateShard)
+
+	// b fails the first write after the second one was acknowledged
+	backend.fail("b", errors.New("b is down"))
+	backend.delay("b", 20*time.Millisecond)
+	c.Assert(write(server, 1), IsNil)
+	c.Assert(write(server, 2), IsNil)
+	waitFor(c, func() bool { return r.Stats()["b"].Hints == 2 })
+	backend.delay("b", 0)
+	c.Assert(backend.written("b"), HasLen, 0)
+
+	// the hints are replayed in order once b is back
+	backend.fail("b", nil)
+	waitFor(c, func() bool { return r.Stats()["b"].Hints == 0 })
+	c.Assert(backend.written("a"), DeepEquals, []int{1, 2})
+	c.Assert(backend.written("b"), DeepEquals, []int{1, 2})
+
+	// the hint queues would be shared with another shard
+	_, err := config.NewShard()
+	c.Assert(err, ErrorMatches, "dilithium: Invalid ReplicateShard config 'hint_path', .* is used by another shard")
+}
+
+func (s *ShardSuite) TestReplicateHintsRestart(c *C) {
+	dir := c.MkDir()
+	config := func(maxAttempts int) dilithium.ShardConfig {
+		return dilithium.ShardConfig{Type: "replicate",
+			Config: map[string]interface{}{"w": "one", "hint_path": dir, "hint_retry": "10ms",
+				"hint_max_attempts": float64(maxAttempts)},
+			Children: []dilithium.ShardConfig{physical("a"), physical("b")}}
+	}
+	server, shard := newTestServer(c, config(0))
+	r := shard.(*dilithium.ReplicateShard)
+	backend.fail("b", errors.New("b is down"))
+	c.Assert(write(server, 1), IsNil)
+	c.Assert(write(server, 2), IsNil)
+	waitFor(c, func() bool { return r.Stats()["b"].Hints == 2 })
+	// closed while retrying the first hint
+	time.Sleep(30 * time.Millisecond)
+	shard.Destroy()
+
+	// the hints wait for a query without using up their single attempt, and
+	// are replayed in their original order
+	backend.fail("b", nil)
+	server, shard = newTestServer(c, config(1))
+	defer shard.Destroy()
+	r = shard.(*dilithium.ReplicateShard)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(r.Stats()["b"].Hints, Equals, int64(2))
+	_, err := read(server, 3)
+	c.Assert(err, IsNil)
+	waitFor(c, func() bool { return r.Stats()["b"].Hints == 0 })
+	c.Assert(backend.written("b"), DeepEquals, []int{1, 2})
+}
+
+// waitFor polls cond until it returns true, failing the test after a second.
+func waitFor(c *C, cond func() bool) {
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			c.Fatal("condition not met within 1s")
+		}
+	}
+}
+
+func (s *ShardSuite) TestPrimaryPromote(c *C) {
+	config := dilithium.ShardConfig{Type: "primary", Config: map[string]interface{}{"read_fallback": true},
+		Children: []dilithium.ShardConfig{physical("a"), physical("b")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+
+	c.Assert(write(server, 1), IsNil)
+	c.Assert(backend.written("a"), DeepEquals, []int{1})
+	c.Assert(backend.written("b"), HasLen, 0)
+	url, err := read(server, 1)
+	c.Assert(err, IsNil)
+	c.Assert(url, Equals, "b")
+
+	c.Assert(server.Promote("b"), IsNil)
+	c.Assert(write(server, 2), IsNil)
+	c.Assert(backend.written("b"), DeepEquals, []int{2})
+	exported, err := dilithium.NewShardConfig(shard)
+	c.Assert(err, IsNil)
+	c.Assert(exported.Config["primary"], Equals, "b")
+
+	// reads fall back to the primary
+	backend.fail("a", errors.New("a is down"))
+	url, err = read(server, 1)
+	c.Assert(err, IsNil)
+	c.Assert(url, Equals, "b")
+
+	c.Assert(server.Promote("c"), ErrorMatches, "dilithium: could not find shard 'c'")
+
+	// without its primary, the shard still serves reads
+	backend.fail("a", nil)
+	shard.RemoveChild("b")
+	c.Assert(write(server, 3), ErrorMatches, "dilithium: PrimaryShard primary 'b' is not a child")
+	url, err = read(server, 1)
+	c.Assert(err, IsNil)
+	c.Assert(url, Equals, "a")
+}
+
+func (s *ShardSuite) TestPrimaryPromoteNodeNames(c *C) {
+	// the primary is recorded by node name, so that it survives a reload of
+	// children without stable IDs
+	pair := func(a, b string) dilithium.ShardConfig {
+		return dilithium.ShardConfig{Type: "replicate", Children: []dilithium.ShardConfig{physical(a), physical(b)}}
+	}
+	config := dilithium.ShardConfig{Type: "primary",
+		Children: []dilithium.ShardConfig{pair("a", "b"), pair("c", "d")}}
+	server, shard := newTestServer(c, config)
+	c.Assert(server.Promote(shard.Children()[1].ID()), IsNil)
+	exported, err := dilithium.NewShardConfig(shard)
+	c.Assert(err, IsNil)
+	c.Assert(exported.Config["primary"], Equals, "1")
+	c.Assert(exported.Config["nodes"], DeepEquals, []interface{}{"0", "1"})
+	shard.Destroy()
+
+	server, shard = newTestServer(c, *exported)
+	defer shard.Destroy()
+	c.Assert(write(server, 1), IsNil)
+	c.Assert(backend.written("a"), HasLen, 0)
+	c.Assert(backend.written("c"), DeepEquals, []int{1})
+	c.Assert(backend.written("d"), DeepEquals, []int{1})
+}
+
+func (s *ShardSuite) TestPrimaryFailover(c *C) {
+	config := dilithium.ShardConfig{Type: "primary", Config: map[string]interface{}{"primary": "b", "failover_after": float64(2), "strategy": "round_robin"},
+		Children: []dilithium.ShardConfig{physical("a"), physical("b"), physical("c")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+
+	backend.fail("a", errors.New("a is down"))
+	backend.fail("b", errors.New("b is down"))
+	// the read fails over from a to c, marking a down
+	_, err := read(server, 1)
+	c.Assert(err, IsNil)
+	c.Assert(write(server, 1), NotNil)
+	c.Assert(write(server, 2), NotNil)
+
+	// a is down, so c is promoted
+	c.Assert(write(server, 3), IsNil)
+	c.Assert(backend.written("c"), DeepEquals, []int{3})
+	c.Assert(shard.Config()["primary"], Equals, "c")
+}
+
+func (s *ShardSuite) TestHashRemap(c *C) {
+	config := dilithium.ShardConfig{Type: "hash",
+		Children: []dilithium.ShardConfig{physical("a"), physical("b"), physical("c")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+
+	owners := make(map[int]string)
+	counts := make(map[string]int)
+	for key := 0; key <= 100; key++ {
+		url, err := read(server, key)
+		c.Assert(err, IsNil)
+		owners[key] = url
+		counts[url]++
+	}
+	c.Assert(counts, HasLen, 3)
+
+	// adding a child only moves keys to it
+	dconfig := physical("d")
+	d, err := dconfig.NewShard()
+	c.Assert(err, IsNil)
+	shard.AddChild(d)
+	moved := 0
+	for key := 0; key <= 100; key++ {
+		url, err := read(server, key)
+		c.Assert(err, IsNil)
+		if url != owners[key] {
+			c.Assert(url, Equals, "d")
+			moved++
+		}
+	}
+	c.Assert(moved > 0 && moved < 50, Equals, true)
+
+	// removing it moves them back
+	shard.RemoveChild("d")
+	for key := 0; key <= 100; key++ {
+		url, err := read(server, key)
+		c.Assert(err, IsNil)
+		c.Assert(url, Equals, owners[key])
+	}
+}
+
+func (s *ShardSuite) TestHashReload(c *C) {
+	// children without stable IDs keep their keys across reloads
+	pair := func(a, b string) dilithium.ShardConfig {
+		return dilithium.ShardConfig{Type: "replicate", Children: []dilithium.ShardConfig{physical(a), physical(b)}}
+	}
+	config := dilithium.ShardConfig{Type: "hash",
+		Children: []dilithium.ShardConfig{pair("a", "b"), pair("c", "d"), pair("e", "f")}}
+	group := map[string]string{"a": "0", "b": "0", "c": "1", "d": "1", "e": "2", "f": "2"}
+	owners := func(config dilithium.ShardConfig) map[int]string {
+		server, shard := newTestServer(c, config)
+		defer shard.Destroy()
+		owners := make(map[int]string)
+		for key := 0; key <= 100; key++ {
+			url, err := read(server, key)
+			c.Assert(err, IsNil)
+			owners[key] = group[url]
+		}
+		return owners
+	}
+
+	before := owners(config)
+	c.Assert(owners(config), DeepEquals, before)
+	_, shard := newTestServer(c, config)
+	exported, err := dilithium.NewShardConfig(shard)
+	c.Assert(err, IsNil)
+	shard.Destroy()
+	c.Assert(exported.Config["nodes"], DeepEquals, []interface{}{"0", "1", "2"})
+	c.Assert(owners(*exported), DeepEquals, before)
+}
+
+func (s *ShardSuite) TestRangeNested(c *C) {
+	config := dilithium.ShardConfig{Type: "range",
+		Config: map[string]interface{}{"max_keys": []interface{}{float64(100), float64(10)}},
+		Children: []dilithium.ShardConfig{physical("b"), {Type: "range",
+			Config:   map[string]interface{}{"max_keys": []interface{}{float64(5), float64(10)}},
+			Children: []dilithium.ShardConfig{physical("a1"), physical("a2")}}}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+
+	for key, want := range map[int]string{0: "a1", 5: "a1", 6: "a2", 10: "a2", 11: "b", 100: "b"} {
+		url, err := read(server, key)
+		c.Assert(err, IsNil)
+		c.Assert(url, Equals, want)
+	}
+
+	// the boundaries survive a config round trip
+	exported, err := dilithium.NewShardConfig(shard)
+	c.Assert(err, IsNil)
+	data, err := json.Marshal(exported)
+	c.Assert(err, IsNil)
+	var decoded dilithium.ShardConfig
+	c.Assert(json.Unmarshal(data, &decoded), IsNil)
+	c.Assert(decoded.Config, DeepEquals, config.Config)
+	c.Assert(decoded.Children[1].Config, DeepEquals, config.Children[1].Config)
+
+	// removing a child removes its boundary
+	shard.RemoveChild("b")
+	c.Assert(shard.Config()["max_keys"], DeepEquals, []interface{}{float64(10)})
+	_, err = read(server, 50)
+	c.Assert(err, ErrorMatches, "dilithium: could not find shard for key: 50")
+	cconfig := physical("c")
+	child, err := cconfig.NewShard()
+	c.Assert(err, IsNil)
+	c.Assert(shard.(*dilithium.RangeShard).AddRangeChild(100, child), IsNil)
+	url, err := read(server, 50)
+	c.Assert(err, IsNil)
+	c.Assert(url, Equals, "c")
+}
+
+func (s *ShardSuite) TestRangeIntKeys(c *C) {
+	// configs built in Go may use ints, and keys may be negative
+	config := dilithium.ShardConfig{Type: "range",
+		Config:   map[string]interface{}{"max_keys": []interface{}{100, -1}},
+		Children: []dilithium.ShardConfig{physical("b"), physical("a")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+
+	for key, want := range map[int]string{-5: "a", -1: "a", 0: "b", 100: "b"} {
+		url, err := read(server, key)
+		c.Assert(err, IsNil)
+		c.Assert(url, Equals, want)
+	}
+
+	config.Config["max_keys"] = []interface{}{1.5}
+	_, err := config.NewShard()
+	c.Assert(err, ErrorMatches, "dilithium: Invalid RangeShard config 'max_keys': expecting integer, got 1.5")
+}
+
+func (s *ShardSuite) TestMirrorShadow(c *C) {
+	config := dilithium.ShardConfig{Type: "mirror",
+		Config:   map[string]interface{}{"shadow_timeout": "50ms", "max_shadow_inflight": float64(1)},
+		Children: []dilithium.ShardConfig{physical("a"), physical("b")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+	m := shard.(*dilithium.MirrorShard)
+
+	// the slow shadow neither delays the primary nor queues copies
+	backend.delay("b", time.Second)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		url, err := read(server, 1)
+		c.Assert(err, IsNil)
+		c.Assert(url, Equals, "a")
+	}
+	c.Assert(time.Since(start) < 50*time.Millisecond, Equals, true)
+
+	waitFor(c, func() bool { return m.Stats().ShadowErrors == 1 })
+	stats := m.Stats()
+	c.Assert(stats.Queries, Equals, int64(2))
+	c.Assert(stats.Errors, Equals, int64(0))
+	c.Assert(stats.Mirrored, Equals, int64(1))
+	c.Assert(stats.Dropped, Equals, int64(1))
+	c.Assert(stats.ShadowLastError, Equals, context.DeadlineExceeded.Error())
+
+	backend.delay("b", 0)
+	c.Assert(write(server, 1), IsNil)
+	waitFor(c, func() bool { return len(backend.written("b")) == 1 })
+	c.Assert(backend.written("a"), DeepEquals, []int{1})
+}
+
+func (s *ShardSuite) TestCacheReadThrough(c *C) {
+	config := dilithium.ShardConfig{Type: "cache",
+		Config: map[string]interface{}{
+			"get":      map[string]interface{}{"BackendService.Read": "CacheService.Get"},
+			"fill":     map[string]interface{}{"BackendService.Read": "CacheService.Set"},
+			"on_write": map[string]interface{}{"BackendService.Write": "CacheService.Delete"},
+		},
+		Children: []dilithium.ShardConfig{physical("cache"), physical("b")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+	c.Assert(server.Register(&CacheService{}), IsNil)
+	cs := shard.(*dilithium.CacheShard)
+
+	get := func() string {
+		q := &dilithium.Query{Method: "BackendService.Read", Arg: BackendKey(1)}
+		c.Assert(server.Query(context.Background(), q), IsNil)
+		c.Assert(*q.Reply.(*string), Equals, "b")
+		return q.ServedBy
+	}
+	c.Assert(get(), Equals, "b")
+	c.Assert(get(), Equals, "cache")
+	c.Assert(backend.readCount("b"), Equals, 1)
+
+	// writes invalidate the cached entry
+	c.Assert(write(server, 1), IsNil)
+	c.Assert(get(), Equals, "b")
+	c.Assert(cs.Stats(), DeepEquals, dilithium.CacheStats{Hits: 1, Misses: 2, Fills: 2, Updates: 1})
+
+	// a failed update does not fail the committed write
+	backend.fail("cache", errors.New("cache is down"))
+	c.Assert(write(server, 1), IsNil)
+	c.Assert(backend.written("b"), DeepEquals, []int{1, 1})
+	c.Assert(cs.Stats().UpdateErrors, Equals, int64(1))
+}
+
+func (s *ShardSuite) TestCacheArgType(c *C) {
+	config := dilithium.ShardConfig{Type: "cache",
+		Config:   map[string]interface{}{"get": map[string]interface{}{"BackendService.Read": "CacheService.GetOther"}},
+		Children: []dilithium.ShardConfig{physical("cache"), physical("b")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+	c.Assert(server.Register(&CacheService{}), IsNil)
+
+	// the mismatched cache method is reported as a cache error
+	url, err := read(server, 1)
+	c.Assert(err, IsNil)
+	c.Assert(url, Equals, "b")
+	c.Assert(shard.(*dilithium.CacheShard).Stats().CacheErrors, Equals, int64(1))
+}
+
+func (s *ShardSuite) TestWriteBehind(c *C) {
+	config := dilithium.ShardConfig{Type: "writebehind",
+		Config: map[string]interface{}{"queue_path": c.MkDir(), "queue_name": "a", "retry": "5ms",
+			"max_attempts": float64(2)},
+		Children: []dilithium.ShardConfig{physical("a")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+	w := shard.(*dilithium.WriteBehindShard)
+
+	// writes are acknowledged before the child applies them
+	backend.delay("a", 200*time.Millisecond)
+	start := time.Now()
+	for key := 1; key <= 3; key++ {
+		c.Assert(write(server, key), IsNil)
+	}
+	c.Assert(time.Since(start) < 200*time.Millisecond, Equals, true)
+	c.Assert(w.Stats().Depth > 0, Equals, true)
+	waitFor(c, func() bool { return w.Stats().Lag > 0 })
+	waitFor(c, func() bool { return w.Stats().Applied == 3 })
+	backend.delay("a", 0)
+	c.Assert(backend.written("a"), DeepEquals, []int{1, 2, 3})
+
+	backend.fail("a", errors.New("a is down"))
+	c.Assert(write(server, 4), IsNil)
+	waitFor(c, func() bool { return w.Stats().DeadLettered == 1 })
+	backend.fail("a", nil)
+	c.Assert(write(server, 5), IsNil)
+	waitFor(c, func() bool { return w.Stats().Depth == 0 && w.Stats().Applied == 4 })
+
+	stats := w.Stats()
+	c.Assert(backend.written("a"), DeepEquals, []int{1, 2, 3, 5})
+	c.Assert(stats.Retries, Equals, int64(1))
+	c.Assert(stats.LastError, Equals, "a is down")
+}
+
+func (s *ShardSuite) TestWriteBehindRestart(c *C) {
+	dir := c.MkDir()
+	config := func(maxAttempts int) dilithium.ShardConfig {
+		return dilithium.ShardConfig{Type: "writebehind",
+			Config: map[string]interface{}{"queue_path": dir, "queue_name": "a", "retry": "10ms",
+				"max_attempts": float64(maxAttempts)},
+			Children: []dilithium.ShardConfig{physical("a")}}
+	}
+	server, shard := newTestServer(c, config(0))
+	w := shard.(*dilithium.WriteBehindShard)
+	backend.fail("a", errors.New("a is down"))
+	for key := 1; key <= 3; key++ {
+		c.Assert(write(server, key), IsNil)
+	}
+	// closed while retrying the first write
+	waitFor(c, func() bool { return w.Stats().Retries > 0 })
+	shard.Destroy()
+
+	// the writes wait for a query without using up their single attempt, and
+	// are applied in their original order
+	backend.fail("a", nil)
+	server, shard = newTestServer(c, config(1))
+	defer shard.Destroy()
+	w = shard.(*dilithium.WriteBehindShard)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(w.Stats().Depth, Equals, int64(3))
+	c.Assert(w.Stats().DeadLettered, Equals, int64(0))
+	_, err := read(server, 1)
+	c.Assert(err, IsNil)
+	waitFor(c, func() bool { return w.Stats().Applied == 3 })
+	c.Assert(backend.written("a"), DeepEquals, []int{1, 2, 3})
+
+	// the queue would be shared with the running shard
+	shared := config(1)
+	_, err = shared.NewShard()
+	c.Assert(err, ErrorMatches, "dilithium: Invalid WriteBehindShard config 'queue_name', a is used by another shard in .*")
+
+	unnamed := dilithium.ShardConfig{Type: "writebehind", Config: map[string]interface{}{"queue_path": dir}}
+	_, err = unnamed.NewShard()
+	c.Assert(err, ErrorMatches, "dilithium: Invalid WriteBehindShard config 'queue_name', .*")
+}
+
+func (s *ShardSuite) TestMigratePhases(c *C) {
+	config := dilithium.ShardConfig{Type: "migrate",
+		Children: []dilithium.ShardConfig{physical("old"), physical("new")}}
+	server, shard := newTestServer(c, config)
+	defer shard.Destroy()
+	m := shard.(*dilithium.MigrateShard)
+
+	c.Assert(write(server, 1), IsNil)
+	c.Assert(server.SetMigrationPhase("new", dilithium.PhaseDualWriteReadOld), IsNil)
+	c.Assert(write(server, 2), IsNil)
+	url, err := read(server, 2)
+	c.Assert(err, IsNil)
+	c.Assert(url, Equals, "old")
+
+	// the new store failing is a divergence, not a failed write
+	backend.fail("new", errors.New("new is down"))
+	c.Assert(write(server, 3), IsNil)
+	backend.fail("new", nil)
+	c.Assert(m.Stats(), DeepEquals, dilithium.MigrateStats{DualWrites: 2, Divergences: 1,
+		LastDivergence: "BackendService.Write failed on new store: new is down"})
+
+	c.Assert(server.SetMigrationPhase("old", dilithium.PhaseDualWriteReadNew), IsNil)
+	url, err = read(server, 2)
+	c.Assert(err, IsNil)
+	c.Assert(url, Equals, "new")
+
+	c.Assert(server.SetMigrationPhase("new", dilithium.PhaseNewOnly), IsNil)
+	c.Assert(write(server, 4), IsNil)
+	c.Assert(backend.written("old"), DeepEquals, []int{1, 2, 3})
+	c.Assert(backend.written("new"), DeepEquals, []int{2, 4})
+
+	exported, err := dilithium.NewShardConfig(shard)
+	c.Assert(err, IsNil)
+	c.Assert(exported.Config["phase"], Equals, dilithium.PhaseNewOnly)
+	c.Assert(server.SetMigrationPhase("new", "done"), ErrorMatches, "dilithium: invalid MigrateShard phase 'done'")
+}
+
+func (s *ShardSuite) TestReplicateQuorumInvalid(c *C) {
+	config := dilithium.ShardConfig{Type: "replicate", Config: map[string]interface{}{"w": "most"}}
+	_, err := config.NewShard()
+	c.Assert(err, ErrorMatches, "dilithium: Invalid ReplicateShard config 'w'.*")
+
+	config = dilithium.ShardConfig{Type: "replicate", Config: map[string]interface{}{"w": float64(3)},
+		Children: []dilithium.ShardConfig{physical("a"), physical("b")}}
+	server, shard := newTestServer(c, config)
+	c.Assert(write(server, 1), ErrorMatches, "dilithium: ReplicateShard write quorum of 3 exceeds its 2 children")
+	c.Assert(backend.written("a"), HasLen, 0)
+	shard.RemoveChild("a")
+	shard.RemoveChild("b")
+	c.Assert(write(server, 1), ErrorMatches, "dilithium: ReplicateShard has no children")
+	shard.Destroy()
+
+	config.Config = map[string]interface{}{"hedge_delay": "p99"}
+	_, err = config.NewShard()
+	c.Assert(err, ErrorMatches, "dilithium: Invalid ReplicateShard config 'hedge_delay'.*")
+}
+
+func init() {
+	dilithium.RegisterPoolType("test", &dilithium.Pool{Dial: testDial})
+	dilithium.RegisterTypedPoolType("backend", dilithium.NewTypedPool(func(url string) (*BackendConn, error) {
+		return &BackendConn{url}, nil
+	}, 1))
+}
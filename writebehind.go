@@ -0,0 +1,268 @@
+package dilithium
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cupcake/dilithium/queue"
+)
+
+// WriteBehindShard acknowledges writes once they are appended to a DiskQueue
+// in 'queue_path' and applies them to its child in order from a background
+// worker. Reads go to the child directly, so they may not see queued writes.
+//
+// A write the child fails is retried every 'retry' (1s by default). After
+// 'max_attempts' failures (unlimited by default), or at once if it cannot be
+// decoded, it is handled by the 'dead_letter' policy: "queue" (the default)
+// appends it to a dead letter DiskQueue next to the write queue, "drop"
+// discards it. The queues are named after the required 'queue_name', and
+// Setup rejects a name used by another shard in the same 'queue_path'. Queued writes left by a previous run,
+// including the one being applied, are applied in order once the shard has
+// received a query.
+type WriteBehindShard struct {
+	baseShard
+	path        string
+	name        string
+	retry       time.Duration
+	maxAttempts int
+	dropDead    bool
+	timeout     time.Duration
+	server      atomic.Pointer[rpcServer]
+
+	replayer *queueReplayer
+	dead     queue.Queue
+	stats    writeBehindStats
+}
+
+// WriteBehindStats contains the statistics of a WriteBehindShard.
+type WriteBehindStats struct {
+	// Depth is the number of writes not applied yet.
+	Depth int64
+	// Lag is the time since the oldest write not applied yet was queued.
+	Lag          time.Duration
+	Applied      int64
+	Retries      int64
+	DeadLettered int64
+	LastError    string
+}
+
+type writeBehindStats struct {
+	sync.Mutex
+	WriteBehindStats
+	queued time.Time // when the write being applied was queued
+}
+
+var errNoWriteBehindChild = errors.New("dilithium: WriteBehindShard has no child")
+
+func (w *WriteBehindShard) Setup(config map[string]interface{}) error {
+	path, ok := config["queue_path"].(string)
+	if !ok {
+		return fmt.Errorf("dilithium: Invalid WriteBehindShard config 'queue_path', expecting string, got %T", config["queue_path"])
+	}
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		return fmt.Errorf("dilithium: Invalid WriteBehindShard config 'queue_path', %s is not a directory", path)
+	}
+	name, ok := config["queue_name"].(string)
+	if !ok || name == "" {
+		return fmt.Errorf("dilithium: Invalid WriteBehindShard config 'queue_name', expecting non-empty string, got %v", config["queue_name"])
+	}
+	retry, ok, err := configDuration(config, "retry")
+	if err != nil {
+		return fmt.Errorf("dilithium: Invalid WriteBehindShard config 'retry': %s", err)
+	}
+	if !ok {
+		retry = defaultQueueRetry
+	}
+	maxAttempts, _, err := configInt(config, "max_attempts")
+	if err != nil {
+		return fmt.Errorf("dilithium: Invalid WriteBehindShard config 'max_attempts': %s", err)
+	}
+	timeout, _, err := configDuration(config, "timeout")
+	if err != nil {
+		return fmt.Errorf("dilithium: Invalid WriteBehindShard config 'timeout': %s", err)
+	}
+	var dropDead bool
+	switch v := config["dead_letter"]; v {
+	case nil, "queue":
+	case "drop":
+		dropDead = true
+	default:
+		return fmt.Errorf("dilithium: Invalid WriteBehindShard config 'dead_letter', expecting queue or drop, got %v", v)
+	}
+	if !claimQueuePath(writeBehindQueuePath(path, name)) {
+		return fmt.Errorf("dilithium: Invalid WriteBehindShard config 'queue_name', %s is used by another shard in %s", name, path)
+	}
+	w.Lock()
+	w.setup(config)
+	w.path = path
+	w.name = name
+	w.retry = retry
+	w.maxAttempts = maxAttempts
+	w.dropDead = dropDead
+	w.timeout = timeout
+	w.Unlock()
+	return nil
+}
+
+// writeBehindQueueName returns the name of the DiskQueue of the shard with
+// the given 'queue_name'.
+func writeBehindQueueName(name string) string {
+	return "writebehind." + url.QueryEscape(name)
+}
+
+func writeBehindQueuePath(path, name string) string {
+	return filepath.Join(path, writeBehindQueueName(name))
+}
+
+// AddChild adds the child and starts applying queued writes to it. The shard
+// has a single child; further children are ignored.
+func (w *WriteBehindShard) AddChild(s Shard) {
+	w.Lock()
+	defer w.Unlock()
+	if len(w.children) > 0 {
+		log.Printf("dilithium: WriteBehindShard already has child '%s', ignoring '%s'", w.children[0].ID(), s.ID())
+		return
+	}
+	w.children = append(w.children, s)
+	name := writeBehindQueueName(w.name)
+	w.replayer = newQueueReplayer(w.path, name, w.retry, w.maxAttempts, &w.server)
+	w.replayer.apply = func(q *Query) error { return w.run(s, q) }
+	w.replayer.begin = w.begin
+	w.replayer.fail = w.fail
+	w.replayer.finish = w.finish
+	if !w.dropDead {
+		w.dead = queue.NewDiskQueue(name+".dead", w.path, queueMaxBytesPerFile, queueSyncEvery)
+	}
+	w.replayer.start()
+}
+
+func (w *WriteBehindShard) RemoveChild(id string) {
+	w.Lock()
+	if len(w.children) > 0 && w.children[0].ID() == id {
+		w.close()
+	}
+	_, s := w.removeChild(id)
+	w.Unlock()
+	destroyChild(s)
+}
+
+func (w *WriteBehindShard) Destroy() {
+	w.Lock()
+	w.close()
+	if w.path != "" {
+		releaseQueuePath(writeBehindQueuePath(w.path, w.name))
+	}
+	for _, s := range w.children {
+		s.Destroy()
+	}
+}
+
+// close stops the worker and closes the queues, keeping the queued writes on
+// disk. The caller must hold w's lock.
+func (w *WriteBehindShard) close() {
+	if w.replayer == nil {
+		return
+	}
+	if err := w.replayer.close(); err != nil {
+		log.Printf("dilithium: failed to close WriteBehindShard queue: %s", err)
+	}
+	if w.dead != nil {
+		if err := w.dead.Close(); err != nil {
+			log.Printf("dilithium: failed to close WriteBehindShard queue: %s", err)
+		}
+	}
+	w.replayer, w.dead = nil, nil
+}
+
+func (w *WriteBehindShard) Query(ctx context.Context, q *Query) error {
+	if q.server != nil {
+		w.server.Store(q.server)
+	}
+	w.RLock()
+	defer w.RUnlock()
+	if len(w.children) == 0 {
+		return errNoWriteBehindChild
+	}
+	if q.ReadOnly() {
+		return w.children[0].Query(ctx, q)
+	}
+	data, err := encodeQuery(q)
+	if err != nil {
+		return err
+	}
+	return w.replayer.queue.Put(data)
+}
+
+// run applies a queued write to child.
+func (w *WriteBehindShard) run(child Shard, q *Query) error {
+	ctx := context.Background()
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+	}
+	return child.Query(ctx, q)
+}
+
+func (w *WriteBehindShard) begin(queued time.Time) {
+	w.stats.Lock()
+	w.stats.queued = queued
+	w.stats.Unlock()
+}
+
+func (w *WriteBehindShard) fail(err error) {
+	w.stats.Lock()
+	w.stats.Retries++
+	w.stats.LastError = err.Error()
+	w.stats.Unlock()
+}
+
+// finish records a write once it is applied, or dead letters it.
+func (w *WriteBehindShard) finish(data []byte, err error) {
+	w.stats.Lock()
+	w.stats.queued = time.Time{}
+	if err == nil {
+		w.stats.Applied++
+	} else {
+		w.stats.DeadLettered++
+		w.stats.LastError = err.Error()
+	}
+	w.stats.Unlock()
+	if err == nil {
+		return
+	}
+	if w.dead == nil {
+		log.Printf("dilithium: dropping write for '%s': %s", w.name, err)
+		return
+	}
+	if perr := w.dead.Put(data); perr != nil {
+		log.Printf("dilithium: failed to dead letter write for '%s': %s", w.name, perr)
+	}
+}
+
+// Stats returns the write-behind statistics.
+func (w *WriteBehindShard) Stats() WriteBehindStats {
+	w.RLock()
+	var depth int64
+	if w.replayer != nil {
+		depth = w.replayer.depth()
+	}
+	w.RUnlock()
+
+	w.stats.Lock()
+	defer w.stats.Unlock()
+	stats := w.stats.WriteBehindStats
+	stats.Depth = depth
+	if !w.stats.queued.IsZero() {
+		stats.Lag = nowFunc().Sub(w.stats.queued)
+	}
+	return stats
+}